@@ -1,5 +1,5 @@
 module github.com/Tacoman44444/killiardsgame
 
-go 1.23.2
+go 1.24
 
 require github.com/gorilla/websocket v1.5.3
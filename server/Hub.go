@@ -1,22 +1,17 @@
 package main
 
 import (
-	"fmt"
+	"cmp"
+	"log/slog"
 	"math/rand"
 	"net/http"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // allow all origins during dev, change  production
-	},
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
 type PlayerJoinData struct {
 	Username string `json:"username"`
 	Code     string `json:"code"`
@@ -28,31 +23,97 @@ const (
 	HubSendPlayerToLobby HubMessageType = iota
 	HubPlayerInvalidCode
 	HubRoomCreated
+	HubResumeSession
+	HubShutdown           // to lobbies: close once any shot in flight has settled
+	HubServerShuttingDown // to players: the server goes away after countdown
+	HubSendSpectatorToLobby
+	HubQueued           // from the matchmaker: the player is in the match queue
+	HubReadyCheck       // from the matchmaker: a match was found, confirm within countdown
+	HubReadyCheckFailed // from the matchmaker: the match fell through, see requeued
 )
 
+const HUB_QUEUE_SIZE = 4 // hub messages waiting for the player goroutine
+
 type HubMessage struct {
-	msgType HubMessageType
-	code    string
-	player  *Player
-	lobby   *Lobby
+	msgType   HubMessageType
+	code      string
+	token     string
+	player    *Player
+	lobby     *Lobby
+	conn      *websocket.Conn
+	countdown time.Duration
+	players   int // how many are in the ready check
+	reason    string
+	requeued  bool // the player is back in the match queue
+}
+
+// ResumeRequest carries a reconnecting client's socket from ServeWs to the hub.
+// The hub answers on accepted, which must be buffered.
+type ResumeRequest struct {
+	token    string
+	conn     *websocket.Conn
+	accepted chan bool
 }
 
 type Hub struct {
 	readPlayer chan PlayerMessage
 	readLobby  chan LobbyMessage
+	readResume chan ResumeRequest
+	readList   chan chan []LobbyInfo // list-lobbies and GET /lobbies ask for the open lobbies here
+	readMatch  chan []*Player        // groups that passed the matchmaker's ready check
+	matchmaker *Matchmaker
+	store      Store
+	sessions   *Sessions
+	secret     []byte
+	config     Config
+	log        *slog.Logger
+	metrics    *Metrics
+	upgrader   websocket.Upgrader
+	shutdown   chan time.Duration
+	draining   atomic.Bool   // set once shutdown starts, read by ServeWs
+	done       chan struct{} // closed once every lobby has closed after a shutdown
 }
 
-func NewHub() *Hub {
-	return &Hub{make(chan PlayerMessage), make(chan LobbyMessage)}
+func NewHub(config Config, logger *slog.Logger, store Store) *Hub {
+	hub := &Hub{
+		readPlayer: make(chan PlayerMessage),
+		readLobby:  make(chan LobbyMessage),
+		readResume: make(chan ResumeRequest),
+		readList:   make(chan chan []LobbyInfo),
+		readMatch:  make(chan []*Player),
+		shutdown:   make(chan time.Duration),
+		done:       make(chan struct{}),
+		store:      store,
+		sessions:   NewSessions(),
+		secret:     NewSessionSecret(),
+		config:     config,
+		log:        logger,
+		metrics:    NewMetrics(),
+		upgrader: websocket.Upgrader{
+			CheckOrigin:     config.CheckOrigin,
+			ReadBufferSize:  config.ReadBufferSize,
+			WriteBufferSize: config.WriteBufferSize,
+		},
+	}
+	hub.matchmaker = NewMatchmaker(hub, realClock{})
+	return hub
 }
 
 func (h *Hub) Run() {
 	lobbies := make(map[string]*Lobby)
+	connected := make(map[string]*Player) // every player with a running goroutine
 
 	for {
 		select {
 		case plrmsg := <-h.readPlayer:
-			if plrmsg.msgType == PlayerJoinRoom {
+			if h.draining.Load() && (plrmsg.msgType == PlayerJoinRoom || plrmsg.msgType == PlayerCreateRoom || plrmsg.msgType == PlayerJoinAsSpectator || plrmsg.msgType == PlayerQuickPlay) {
+				plrmsg.player.readHub <- HubMessage{msgType: HubServerShuttingDown}
+				continue
+			}
+
+			if plrmsg.msgType == PlayerConnected {
+				connected[plrmsg.senderID] = plrmsg.player
+			} else if plrmsg.msgType == PlayerJoinRoom {
 				lobby, ok := lobbies[plrmsg.msg.JoinData.Code]
 				if ok {
 
@@ -62,62 +123,277 @@ func (h *Hub) Run() {
 						player:  plrmsg.player,
 						lobby:   lobby,
 					}
+					// the lobby knows whether it has room, so it answers the player
 					lobby.readHub <- hubmsg
-					plrmsg.player.readHub <- hubmsg
 				} else {
-					fmt.Println("the code recieved by player: ", plrmsg.msg.JoinData.Code)
+					h.log.Info("join with an unknown lobby code", "lobby", plrmsg.msg.JoinData.Code, "player", plrmsg.senderID)
 					hubmsg := HubMessage{
 						msgType: HubPlayerInvalidCode,
 					}
 					plrmsg.player.readHub <- hubmsg
 				}
+			} else if plrmsg.msgType == PlayerJoinAsSpectator {
+				lobby, ok := lobbies[plrmsg.msg.JoinData.Code]
+				if ok {
+					hubmsg := HubMessage{
+						msgType: HubSendSpectatorToLobby,
+						code:    plrmsg.msg.JoinData.Code,
+						player:  plrmsg.player,
+						lobby:   lobby,
+					}
+					lobby.readHub <- hubmsg
+				} else {
+					h.log.Info("spectate with an unknown lobby code", "lobby", plrmsg.msg.JoinData.Code, "player", plrmsg.senderID)
+					plrmsg.player.readHub <- HubMessage{msgType: HubPlayerInvalidCode}
+				}
 			} else if plrmsg.msgType == PlayerCreateRoom {
-
-				newCode := RandomUppercaseString6()
-				fmt.Println("created new lobby code")
-				lobby := NewLobby(h, newCode, plrmsg.player)
-				lobbies[newCode] = lobby
-				go lobby.Run()
-				fmt.Println("new lobby created")
-				hubmsg := HubMessage{
-					msgType: HubRoomCreated,
-					code:    newCode,
-					player:  plrmsg.player,
-					lobby:   lobby,
+				lobby := h.CreateLobby(plrmsg.player, TurnTimerFromSeconds(plrmsg.msg.TurnTimer, h.config.TurnTimerSeconds), plrmsg.msg.Visibility == "public")
+				lobbies[lobby.code] = lobby
+			} else if plrmsg.msgType == PlayerQuickPlay {
+				// the fullest open lobby starts soonest. skip holds lobbies that
+				// already turned this player away, their listing was out of date.
+				open := slices.DeleteFunc(OpenLobbies(lobbies), func(info LobbyInfo) bool { return slices.Contains(plrmsg.skip, info.Code) })
+				if len(open) > 0 {
+					code := open[0].Code
+					h.log.Info("quick play found a lobby", "lobby", code, "player", plrmsg.senderID)
+					lobbies[code].readHub <- HubMessage{
+						msgType: HubSendPlayerToLobby,
+						code:    code,
+						player:  plrmsg.player,
+						lobby:   lobbies[code],
+					}
+				} else {
+					lobby := h.CreateLobby(plrmsg.player, TurnTimerFromSeconds(0, h.config.TurnTimerSeconds), true)
+					lobbies[lobby.code] = lobby
 				}
-				fmt.Println("informing player that a lobby has been created")
-
-				plrmsg.player.readHub <- hubmsg
+			} else if plrmsg.msgType == PlayerEndSession {
+				h.sessions.End(plrmsg.player)
+				if connected[plrmsg.senderID] == plrmsg.player {
+					delete(connected, plrmsg.senderID)
+				}
+			}
+		case req := <-h.readResume:
+			claims, valid := VerifySessionToken(h.secret, req.token)
+			player, ok := h.sessions.Get(claims.PlayerID)
+			if !valid || !ok || SessionExpired(claims, time.Now()) {
+				h.log.Info("rejected a resume request", "lobby", claims.LobbyCode, "player", claims.PlayerID)
+				req.accepted <- false
+				continue
 			}
+			player.readHub <- HubMessage{
+				msgType: HubResumeSession,
+				code:    claims.LobbyCode,
+				player:  player,
+				conn:    req.conn,
+			}
+			req.accepted <- true
+		case players := <-h.readMatch:
+			if lobby := h.OpenMatch(players, connected); lobby != nil {
+				lobbies[lobby.code] = lobby
+				go lobby.Run()
+			}
+		case reply := <-h.readList:
+			reply <- OpenLobbies(lobbies)
 		case lbmsg := <-h.readLobby:
 			if lbmsg.msgType == LobbyClose {
 				lobby, ok := lobbies[lbmsg.lobbyCode]
 				if !ok {
-					fmt.Println("lobby does not exist, wtf?")
-
+					h.log.Error("close from a lobby the hub doesn't know", "lobby", lbmsg.lobbyCode)
+					continue
 				}
-				fmt.Println("lobby GONE RIPRIPRIP")
-				close(lobby.readHub)
-				close(lobby.Inbound)
+				h.log.Info("lobby closed", "lobby", lbmsg.lobbyCode)
+				close(lobby.done)
 				delete(lobbies, lbmsg.lobbyCode)
+				if h.draining.Load() && len(lobbies) == 0 {
+					close(h.done)
+				}
+			}
+		case countdown := <-h.shutdown:
+			h.log.Info("shutting down", "lobbies", len(lobbies), "players", len(connected))
+			h.draining.Store(true)
+			for _, player := range connected {
+				// a player that can't take this right now will find out when the socket closes
+				select {
+				case player.readHub <- HubMessage{msgType: HubServerShuttingDown, countdown: countdown}:
+				default:
+				}
+			}
+			for _, lobby := range lobbies {
+				lobby.readHub <- HubMessage{msgType: HubShutdown}
+			}
+			if len(lobbies) == 0 {
+				close(h.done)
 			}
 		}
 	}
 }
 
+// Shutdown stops the hub taking new players, warns everyone connected that the
+// server goes away after countdown and closes every lobby. The returned channel
+// is closed once the last lobby is gone.
+func (h *Hub) Shutdown(countdown time.Duration) <-chan struct{} {
+	h.shutdown <- countdown
+	return h.done
+}
+
 func (h *Hub) ServeWs(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	if h.draining.Load() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		h.log.Warn("websocket upgrade failed", "err", err, "remote", r.RemoteAddr)
+		return
+	}
+	h.metrics.ConnectionOpened()
+	conn.SetReadLimit(h.config.MaxMessageSize)
+
+	// a client coming back from a dropped connection opens with a resume
+	// message, anything else is the first message of a brand new player.
+	// players can idle on the main menu for a while, so keep the socket
+	// alive until they pick something.
+	msg := ClientMessage{}
+	conn.SetReadDeadline(time.Now().Add(h.config.PongWait()))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(h.config.PongWait()))
+		return nil
+	})
+	stopPings := make(chan struct{})
+	go h.KeepAlive(conn, stopPings)
+	err = conn.ReadJSON(&msg)
+	close(stopPings)
 	if err != nil {
-		fmt.Println("hub: conn error")
+		conn.Close()
+		h.metrics.ConnectionClosed()
 		return
 	}
 
+	if msg.Type == ClientResume {
+		req := ResumeRequest{token: msg.Token, conn: conn, accepted: make(chan bool, 1)}
+		h.readResume <- req
+		if <-req.accepted {
+			return
+		}
+		conn.WriteJSON(newResumeFailedMessage())
+	}
+
 	player := GetNewPlayer(conn, h)
-	fmt.Println("new player just dropped")
+	player.Log().Info("new player just dropped", "remote", r.RemoteAddr)
+	if msg.Type != ClientResume {
+		player.clientMsg <- msg
+	}
+	h.readPlayer <- PlayerMessage{
+		msgType:  PlayerConnected,
+		player:   player,
+		senderID: player.id,
+	}
 
 	go player.Run()
 }
 
+// KeepAlive pings conn until stop is closed. It is used on sockets that have no
+// Player write pump: before a Player owns one, and for replay spectators.
+func (h *Hub) KeepAlive(conn *websocket.Conn, stop chan struct{}) {
+	ticker := time.NewTicker(h.config.PongWait() * 9 / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(h.config.WriteWait()))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// CreateLobby starts a new lobby owned by player and tells the player about it.
+// The caller adds it to the hub's lobbies.
+func (h *Hub) CreateLobby(player *Player, turnTimer time.Duration, public bool) *Lobby {
+	newCode := RandomUppercaseString6()
+	lobby := NewLobby(h, newCode, player, turnTimer, public)
+	go lobby.Run()
+	h.log.Info("lobby created", "lobby", newCode, "player", player.id, "public", public)
+	player.readHub <- HubMessage{
+		msgType: HubRoomCreated,
+		code:    newCode,
+		token:   h.StartSession(player, newCode),
+		player:  player,
+		lobby:   lobby,
+	}
+	return lobby
+}
+
+// OpenMatch opens a lobby for a group that passed its ready check. Players
+// can disconnect between the ready check passing and the hub getting here, so
+// anyone no longer connected is left out, and if that leaves too few to play
+// the rest are told the match fell through. The matchmaker is waiting on the
+// hub meanwhile, so players are told through QueueHubMessage rather than by
+// waiting on their queues. The caller runs the lobby.
+func (h *Hub) OpenMatch(players []*Player, connected map[string]*Player) *Lobby {
+	if h.draining.Load() {
+		for _, player := range players {
+			player.QueueHubMessage(HubMessage{msgType: HubServerShuttingDown})
+		}
+		return nil
+	}
+	seated := slices.DeleteFunc(slices.Clone(players), func(p *Player) bool { return connected[p.id] != p })
+	if len(seated) < max(MATCH_MIN_PLAYERS, h.config.MinLobbyPlayers) {
+		h.log.Info("matched group fell apart before its lobby opened", "players", len(players), "gone", len(players)-len(seated))
+		for _, player := range seated {
+			player.QueueHubMessage(HubMessage{msgType: HubReadyCheckFailed, reason: "player-left", requeued: false})
+		}
+		return nil
+	}
+	code := RandomUppercaseString6()
+	lobby := NewMatchedLobby(h, code, seated)
+	h.log.Info("lobby created for a matched group", "lobby", code, "players", len(seated))
+	return lobby
+}
+
+// OpenLobbies lists the public lobbies a player could join right now, fullest
+// first.
+func OpenLobbies(lobbies map[string]*Lobby) []LobbyInfo {
+	open := make([]LobbyInfo, 0)
+	for _, lobby := range lobbies {
+		if info := lobby.Info(); info.Open() {
+			open = append(open, info)
+		}
+	}
+	slices.SortFunc(open, func(a, b LobbyInfo) int {
+		if a.Players != b.Players {
+			return b.Players - a.Players
+		}
+		return cmp.Compare(a.Code, b.Code)
+	})
+	return open
+}
+
+// ServeLobbies answers GET /lobbies with the open public lobbies as JSON.
+func (h *Hub) ServeLobbies(w http.ResponseWriter, r *http.Request) {
+	reply := make(chan []LobbyInfo, 1)
+	h.readList <- reply
+	WriteJSON(w, <-reply)
+}
+
+// IssueSessionToken signs a token the client can later present to take its
+// seat back after losing the connection.
+func (h *Hub) IssueSessionToken(player *Player, lobbyCode string) string {
+	return SignSessionToken(h.secret, SessionClaims{PlayerID: player.id, LobbyCode: lobbyCode, IssuedAt: time.Now()})
+}
+
+// StartSession registers player's session and issues its first token. It is
+// called once the lobby has taken the player, so a refused join leaves no
+// session behind.
+func (h *Hub) StartSession(player *Player, lobbyCode string) string {
+	h.sessions.Add(player)
+	return h.IssueSessionToken(player, lobbyCode)
+}
+
 func RandomUppercaseString6() string {
 	letters := []rune("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
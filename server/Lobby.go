@@ -1,10 +1,13 @@
 package main
 
 import (
-	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync/atomic"
+	"time"
 
 	"github.com/Tacoman44444/killiardsgame/server/tools"
-	"github.com/gorilla/websocket"
 )
 
 type LobbyMessageType int
@@ -22,6 +25,12 @@ const (
 	LobbySendGameOver
 	LobbyClose // :<
 	LobbySendPlayerToLobby
+	LobbySendSnapshot
+	LobbyAcceptPlayer
+	LobbyRejectPlayer
+	LobbyRejectAction
+	LobbySendTrajectory
+	LobbyAcceptSpectator
 )
 
 type LobbyMessage struct {
@@ -30,12 +39,22 @@ type LobbyMessage struct {
 	player            PlayerIdentity
 	allPlayers        []PlayerIdentity
 	eliminatedPlayers []PlayerIdentity
+	turnOrder         []string
+	turnNumber        int
+	kills             map[string]int
+	standings         []Standing
+	trajectory        ShotTrajectory
 	walls             []WallState
 	currentMap        tools.MapState
 	nextMap           tools.MapState
 	action            PlayerAction
 	result            string
 	winnerName        string
+	inGame            bool
+	token             string
+	reason            string
+	seed              string
+	lobby             *Lobby
 }
 
 type TurnQueue struct {
@@ -56,7 +75,6 @@ func (q *TurnQueue) Add(p *Player) {
 
 func (q *TurnQueue) RemoveByID(id string) bool {
 	if len(q.data) == 0 {
-		fmt.Println("queue is empty")
 		return false
 	}
 
@@ -69,7 +87,6 @@ func (q *TurnQueue) RemoveByID(id string) bool {
 	}
 
 	if index == -1 {
-		fmt.Println("player not found")
 		return false
 	}
 
@@ -122,60 +139,280 @@ type Lobby struct {
 	readHub           chan HubMessage
 	hub               *Hub
 	gameState         *GameState
-	players           map[*websocket.Conn]*Player
+	players           map[string]*Player
+	seats             []*Player          // players in the order they joined, the seat order for the next match
+	spectators        map[string]*Player // watching only, never seated or in the turn queue
 	queue             *TurnQueue
 	owner             *Player
 	eliminated        []*Player
+	accounts          map[string]string // player id -> account id, as logged in when the match started
+	startedAt         time.Time
 	currentState      LobbyState
 	waitingforplayers LobbyWaitingForPlayers
 	inturn            LobbyInTurn
 	processingturn    LobbyProcessingTurn
 	gameOver          LobbyGameOver
-	simCount          int
+	simAcks           map[string]bool // ids of active players done playing back the last shot
+	settleTime        time.Duration   // how long the server expects that playback to take
+	shuttingDown      bool            // the server is stopping, close once the current shot settles
+	closed            bool
+	done              chan struct{} // closed by the hub once the lobby is gone
+	turnTimer         time.Duration
+	timer             *time.Timer
+	log               *slog.Logger              // carries the lobby attribute, see Log
+	stateEntered      time.Time                 // when currentState was entered, for the metrics
+	result            string                    // how the last match ended, "win" or "draw"
+	turnNumber        int                       // turns started this match, counting from 1
+	replay            *ReplayRecorder           // the match being played, nil between matches
+	public            bool                      // listed by list-lobbies and found by quick-play
+	info              atomic.Pointer[LobbyInfo] // written by Run, read by the hub
 }
 
-func NewLobby(hub *Hub, code string, owner *Player) *Lobby {
+// LobbyInfo is what the lobby browser shows about one lobby.
+type LobbyInfo struct {
+	Code       string `json:"code"`
+	Owner      string `json:"owner"` // the owner's username
+	Players    int    `json:"players"`
+	MaxPlayers int    `json:"max_players"`
+	Spectators int    `json:"spectators"`
+	State      string `json:"state"` // "waiting", "in-game" or "game-over"
+	public     bool
+}
+
+// Open reports whether a player could join the lobby right now.
+func (i LobbyInfo) Open() bool {
+	return i.public && i.State == "waiting" && i.Players < i.MaxPlayers
+}
+
+// NewMatchedLobby seats a group the matchmaker put together and starts their
+// match straight away. Nobody owns it: when the match is over the players can
+// only go back to the main menu.
+func NewMatchedLobby(hub *Hub, code string, players []*Player) *Lobby {
+	lb := NewLobby(hub, code, nil, TurnTimerFromSeconds(0, hub.config.TurnTimerSeconds), false)
+	for _, player := range players {
+		lb.players[player.id] = player
+		lb.seats = append(lb.seats, player)
+		lb.SendToPlayer(player, LobbyMessage{
+			msgType:   LobbyAcceptPlayer,
+			lobbyCode: code,
+			token:     hub.StartSession(player, code),
+			lobby:     lb,
+		})
+	}
+	lb.StartGame("")
+	lb.PublishInfo()
+	return lb
+}
+
+// NewLobby opens a lobby for owner to fill. A nil owner makes an empty lobby,
+// which is how NewMatchedLobby starts.
+func NewLobby(hub *Hub, code string, owner *Player, turnTimer time.Duration, public bool) *Lobby {
 	lb := Lobby{
-		code:      code,
-		Inbound:   make(chan PlayerMessage),
-		readHub:   make(chan HubMessage),
-		hub:       hub,
-		gameState: nil,
-		players:   make(map[*websocket.Conn]*Player),
-		queue:     NewTurnQueue(),
-		owner:     owner,
-		simCount:  0,
+		code:       code,
+		Inbound:    make(chan PlayerMessage),
+		readHub:    make(chan HubMessage),
+		hub:        hub,
+		gameState:  nil,
+		players:    make(map[string]*Player),
+		spectators: make(map[string]*Player),
+		queue:      NewTurnQueue(),
+		owner:      owner,
+		simAcks:    make(map[string]bool),
+		done:       make(chan struct{}),
+		turnTimer:  turnTimer,
+		public:     public,
+		log:        hub.log.With("lobby", code),
 	}
 	lb.waitingforplayers = LobbyWaitingForPlayers{}
 	lb.inturn = LobbyInTurn{}
 	lb.processingturn = LobbyProcessingTurn{}
 	lb.gameOver = LobbyGameOver{}
 	lb.currentState = lb.waitingforplayers
+	lb.RecordTransition(nil, lb.currentState)
 	lb.currentState.Enter(&lb)
-	lb.players[owner.conn] = owner
+	if owner != nil {
+		lb.players[owner.id] = owner
+		lb.seats = append(lb.seats, owner)
+	}
+	lb.PublishInfo()
 
 	return &lb
 }
 
 func (l *Lobby) Run() {
-	fmt.Printf("[LOBBY] Lobby %s is now running\n", l.code)
-	for {
+	l.Log().Info("lobby is now running", "owner", l.OwnerID())
+	defer func() { l.Log().Info("lobby stopped") }()
+	for !l.closed {
 		select {
 		case pm, ok := <-l.Inbound:
 			if !ok {
-				fmt.Printf("[LOBBY] Lobby %s Inbound channel closed\n", l.code)
+				l.Log().Error("inbound channel closed")
 				return
 			}
+			if l.spectators[pm.senderID] == pm.player {
+				l.HandleSpectatorMessage(pm)
+				continue
+			}
 			l.currentState.HandlePlayerMessage(pm, ok, l)
 
 		case hm, ok := <-l.readHub:
 			if !ok {
-				fmt.Printf("[LOBBY] Lobby %s readHub channel closed\n", l.code)
+				l.Log().Error("readHub channel closed")
 				return
 			}
+			// spectators can come in whatever the lobby is doing
+			if hm.msgType == HubSendSpectatorToLobby {
+				l.AddSpectator(hm.player)
+				continue
+			}
 			l.currentState.HandleHubMessage(hm, ok, l)
+
+		case <-l.timerChannel():
+			l.timer = nil
+			l.currentState.HandleTimeout(l)
 		}
+		l.PublishInfo()
+	}
+}
+
+// PublishInfo updates what the hub sees of this lobby. Run calls it after
+// every message, so only the lobby goroutine writes it.
+func (l *Lobby) PublishInfo() {
+	info := LobbyInfo{
+		Code:       l.code,
+		Owner:      l.OwnerName(),
+		Players:    len(l.players),
+		MaxPlayers: l.hub.config.MaxLobbyPlayers,
+		Spectators: len(l.spectators),
+		State:      "waiting",
+		public:     l.public,
+	}
+	switch l.currentState.(type) {
+	case LobbyInTurn, LobbyProcessingTurn:
+		info.State = "in-game"
+	case LobbyGameOver:
+		info.State = "game-over"
+	}
+	l.info.Store(&info)
+}
+
+// OwnerID is the owner's player id, "" for a lobby nobody owns.
+func (l *Lobby) OwnerID() string {
+	if l.owner == nil {
+		return ""
+	}
+	return l.owner.id
+}
+
+func (l *Lobby) OwnerName() string {
+	if l.owner == nil {
+		return ""
+	}
+	return l.owner.username
+}
+
+func (l *Lobby) Info() LobbyInfo {
+	return *l.info.Load()
+}
+
+// SendToPlayer queues a message for one player without blocking the lobby. A
+// player whose queue is full has stopped keeping up, so the message is dropped
+// and the player is told to cut its connection; it can resume and resync.
+func (l *Lobby) SendToPlayer(player *Player, msg LobbyMessage) {
+	select {
+	case player.readLobby <- msg:
+	default:
+		l.LogFor(player.id).Warn("lobby queue full, dropping player connection")
+		select {
+		case player.lagging <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Broadcast sends msg to every player and spectator.
+func (l *Lobby) Broadcast(msg LobbyMessage) {
+	for _, value := range l.players {
+		l.SendToPlayer(value, msg)
+	}
+	l.SendToSpectators(msg)
+}
+
+func (l *Lobby) SendToSpectators(msg LobbyMessage) {
+	for _, value := range l.spectators {
+		l.SendToPlayer(value, msg)
+	}
+}
+
+// AddSpectator lets a player watch the lobby. A spectator gets a snapshot
+// straight away and every broadcast after that, but never gets a puck.
+func (l *Lobby) AddSpectator(player *Player) {
+	if len(l.spectators) >= l.hub.config.MaxSpectators {
+		l.RejectPlayer(player, "spectators-full")
+		return
+	}
+	l.spectators[player.id] = player
+	l.LogFor(player.id).Info("spectator joined", "spectators", len(l.spectators))
+	msg := LobbyMessage{
+		msgType:   LobbyAcceptSpectator,
+		lobbyCode: l.code,
+		token:     l.hub.StartSession(player, l.code),
+		lobby:     l,
+	}
+	l.SendToPlayer(player, msg)
+	l.SendSnapshot(player, l.InGame())
+}
+
+// HandleSpectatorMessage deals with a spectator's messages whatever state the
+// lobby is in, since all a spectator can do is ask for a snapshot or leave.
+func (l *Lobby) HandleSpectatorMessage(pm PlayerMessage) {
+	switch pm.msgType {
+	case PlayerRequestSnapshot:
+		l.SendSnapshot(pm.player, l.InGame())
+	case PlayerLeaveRoom, PlayerDisconnected:
+		delete(l.spectators, pm.senderID)
+		l.LogFor(pm.senderID).Info("spectator left", "spectators", len(l.spectators))
+	}
+}
+
+// ActivePlayerIdentities lists the players still in the turn queue, in turn order.
+func (l *Lobby) ActivePlayerIdentities() []PlayerIdentity {
+	identities := make([]PlayerIdentity, 0, l.queue.Size())
+	for _, p := range l.queue.List() {
+		identities = append(identities, *l.gameState.players[p.id])
+	}
+	return identities
+}
+
+// InGame reports whether a match is being played right now.
+func (l *Lobby) InGame() bool {
+	switch l.currentState.(type) {
+	case LobbyInTurn, LobbyProcessingTurn:
+		return true
 	}
+	return false
+}
+
+// StartTimer arms the lobby's single deadline. When it fires, the current
+// state's HandleTimeout runs on the Run goroutine.
+func (l *Lobby) StartTimer(d time.Duration) {
+	l.StopTimer()
+	l.timer = time.NewTimer(d)
+}
+
+func (l *Lobby) StopTimer() {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+}
+
+// a nil channel blocks forever, so a disarmed timer never wins the select in Run.
+func (l *Lobby) timerChannel() <-chan time.Time {
+	if l.timer == nil {
+		return nil
+	}
+	return l.timer.C
 }
 
 func (l *Lobby) NextTurn() {
@@ -184,10 +421,47 @@ func (l *Lobby) NextTurn() {
 
 func (l *Lobby) SetState(state LobbyState) {
 	l.currentState.Exit(l)
+	l.RecordTransition(l.currentState, state)
 	l.currentState = state
+	l.Log().Debug("lobby changed state")
 	l.currentState.Enter(l)
 }
 
+// RecordTransition updates the metrics that follow from moving between two
+// lobby states. A nil from is a new lobby, a nil to is one that has closed.
+func (l *Lobby) RecordTransition(from, to LobbyState) {
+	metrics := l.hub.metrics
+	metrics.LobbyStateChanged(from, to)
+	if _, ok := from.(LobbyInTurn); ok {
+		metrics.TurnEnded(time.Since(l.stateEntered))
+	}
+	switch to.(type) {
+	case LobbyInTurn:
+		if _, ok := from.(LobbyWaitingForPlayers); ok {
+			metrics.GameStarted()
+		}
+	case LobbyGameOver:
+		metrics.GameFinished(l.result)
+	}
+	l.stateEntered = time.Now()
+}
+
+// Log returns the lobby's logger with the state it is in right now and the
+// player whose turn it is, "" outside a match. Records about some other
+// player go through LogFor instead.
+func (l *Lobby) Log() *slog.Logger {
+	player := ""
+	if l.InGame() && l.queue.Size() > 0 {
+		player = l.queue.Current().id
+	}
+	return l.LogFor(player)
+}
+
+// LogFor is Log for a record about playerID.
+func (l *Lobby) LogFor(playerID string) *slog.Logger {
+	return l.log.With("state", stateName(l.currentState), "player", playerID)
+}
+
 func (l *Lobby) Eliminate() []PlayerIdentity {
 	activePlayers := append([]*Player{}, l.queue.List()...)
 	eliminatedThisRound := make([]PlayerIdentity, 0, 10)
@@ -195,7 +469,10 @@ func (l *Lobby) Eliminate() []PlayerIdentity {
 		if tools.IsPlayerEliminated(l.gameState.mapState, l.gameState.players[activePlayers[i].id].circle.Center) {
 			//DELTE THE PLAYAA
 			if l.queue.RemoveByID(activePlayers[i].id) {
+				l.gameState.players[activePlayers[i].id].alive = false
+				l.gameState.CreditKill(l.gameState.players[activePlayers[i].id])
 				l.eliminated = append(l.eliminated, activePlayers[i])
+				l.gameState.players[activePlayers[i].id].eliminatedOn = l.turnNumber
 				eliminatedThisRound = append(eliminatedThisRound, *l.gameState.players[activePlayers[i].id])
 			}
 		}
@@ -203,17 +480,421 @@ func (l *Lobby) Eliminate() []PlayerIdentity {
 	return eliminatedThisRound
 }
 
+// EndTurn runs at every turn boundary: once every client has finished
+// simulating the last shot, or when the turn timed out. It shrinks the arena
+// when due, ticks the walls, eliminates pucks that fell off and either ends
+// the match or hands the turn to the next player.
+func (l *Lobby) EndTurn() {
+	//eliminate the dead players...
+	//first we shrink the map if 4turns/8turns have happened
+	minTurns := l.gameState.players[l.queue.List()[0].id].turnsPlayed
+	for _, p := range l.queue.List() {
+		if turns := l.gameState.players[p.id].turnsPlayed; turns < minTurns {
+			minTurns = turns
+		}
+	}
+
+	if minTurns == 3 {
+		l.Log().Info("shrinking the arena")
+		nextMap := tools.ShrinkArena(l.gameState.nextMap, l.gameState.rng)
+		l.gameState.mapState = l.gameState.nextMap
+		l.gameState.nextMap = nextMap
+		l.RecordReplay(ReplayEvent{Type: ReplayShrink, Turn: l.turnNumber})
+		msg := LobbyMessage{
+			msgType:    LobbySendMapUpdate,
+			currentMap: *l.gameState.mapState,
+			nextMap:    *l.gameState.nextMap,
+		}
+		l.Broadcast(msg)
+	}
+	if minTurns == 5 {
+		//apply the shrinkmap
+		l.gameState.mapState = l.gameState.nextMap
+		l.RecordReplay(ReplayEvent{Type: ReplayShrinkApplied, Turn: l.turnNumber})
+		msg := LobbyMessage{
+			msgType:    LobbySendMapUpdate,
+			currentMap: *l.gameState.mapState,
+			nextMap:    *l.gameState.nextMap,
+		}
+		l.Broadcast(msg)
+	}
+	l.TickWalls()
+	eliminated := l.Eliminate()
+	if len(eliminated) != 0 {
+		//some1 dead
+		event := ReplayEvent{Type: ReplayEliminations, Turn: l.turnNumber}
+		for _, p := range eliminated {
+			l.LogFor(p.id).Info("player eliminated", "killed_by", p.killedBy, "turn", l.turnNumber)
+			event.Eliminated = append(event.Eliminated, ReplayElimination{Player: p.id, KilledBy: p.killedBy})
+		}
+		l.RecordReplay(event)
+		msg := LobbyMessage{
+			msgType:           LobbySendEliminations,
+			eliminatedPlayers: eliminated,
+			turnNumber:        l.turnNumber,
+		}
+		l.Broadcast(msg)
+
+	} else {
+		l.Log().Debug("everybody lived this turn")
+	}
+	if l.CheckForGameOver() {
+		return
+	}
+	if l.shuttingDown {
+		l.CloseForEveryone()
+		return
+	}
+	l.SetState(l.inturn)
+}
+
+// BroadcastWalls sends every player the walls currently on the board.
+func (l *Lobby) BroadcastWalls() {
+	for _, value := range l.players {
+		msg := LobbyMessage{
+			msgType:    LobbySendWallUpdate,
+			player:     *l.gameState.players[value.id],
+			allPlayers: PlayerMapToSlice(l.gameState.players),
+			walls:      WallStateRefToWallState(l.gameState.walls),
+		}
+		l.SendToPlayer(value, msg)
+	}
+	l.SendToSpectators(LobbyMessage{msgType: LobbySendWallUpdate, walls: WallStateRefToWallState(l.gameState.walls)})
+}
+
+// TickWalls runs at every turn boundary. Walls that have run out are removed
+// and everyone gets the new set.
+func (l *Lobby) TickWalls() {
+	l.RecordReplay(ReplayEvent{Type: ReplayWallsTicked, Turn: l.turnNumber})
+	if l.gameState.TickWalls() {
+		l.Log().Debug("walls expired", "walls_left", len(l.gameState.walls))
+		l.BroadcastWalls()
+	}
+}
+
+// CheckForGameOver ends the match if at most one player is left in the turn
+// queue, and reports whether it did. A lobby draining for a shutdown closes
+// as soon as its match is over.
+func (l *Lobby) CheckForGameOver() bool {
+	if l.queue.Size() == 0 {
+		//we have a draw
+		msg := LobbyMessage{
+			msgType:    LobbySendGameOver,
+			result:     "draw",
+			winnerName: "",
+			kills:      maps.Clone(l.gameState.kills),
+			standings:  l.gameState.Standings(),
+		}
+		l.Broadcast(msg)
+		l.result = "draw"
+		l.RecordReplay(ReplayEvent{Type: ReplayGameOver, Turn: l.turnNumber, Result: "draw", Kills: msg.kills})
+		l.Log().Info("game over", "result", "draw")
+	} else if l.queue.Size() == 1 {
+		//ladies and gentlemen we have a winner
+		msg := LobbyMessage{
+			msgType:    LobbySendGameOver,
+			result:     "win",
+			winnerName: l.queue.Current().username,
+			kills:      maps.Clone(l.gameState.kills),
+			standings:  l.gameState.Standings(),
+		}
+		l.Broadcast(msg)
+		l.result = "win"
+		l.RecordReplay(ReplayEvent{Type: ReplayGameOver, Turn: l.turnNumber, Player: l.queue.Current().id, Result: "win", Kills: msg.kills})
+		l.LogFor(l.queue.Current().id).Info("game over", "result", "win")
+	} else {
+		return false
+	}
+	l.SaveResults()
+	l.SaveReplay()
+	l.SetState(l.gameOver)
+	if l.shuttingDown {
+		l.CloseForEveryone()
+	}
+	return true
+}
+
+// StartGame deals out the board to everyone seated and hands the first turn
+// out. An empty seed picks a new one.
+func (l *Lobby) StartGame(seed string) {
+	playerIDs := make([]string, 0, 10)
+	playerUsernames := make([]string, 0, 10)
+	for _, value := range l.seats {
+		playerIDs = append(playerIDs, value.id)
+		playerUsernames = append(playerUsernames, value.username)
+	}
+	if seed == "" {
+		seed = NewMatchSeed()
+	}
+	l.gameState = GetNewGame(playerIDs, playerUsernames, l.turnTimer, seed)
+	// initialize the turn queue, in seat order so a replayed seed plays out the same
+	for _, value := range l.seats {
+		l.queue.Add(value)
+	}
+	l.turnNumber = 0
+	l.startedAt = time.Now()
+	l.replay = NewReplayRecorder(l.code, l.gameState, l.startedAt)
+	l.accounts = make(map[string]string, len(l.seats))
+	for _, value := range l.seats {
+		if value.account != "" {
+			l.accounts[value.id] = value.account
+		}
+	}
+
+	for _, value := range l.players { //sending the message to all players
+		msg := LobbyMessage{
+			msgType:    LobbySendGameStart,
+			player:     *l.gameState.players[value.id],
+			allPlayers: PlayerMapToSlice(l.gameState.players),
+			walls:      WallStateRefToWallState(l.gameState.walls),
+			currentMap: *l.gameState.mapState,
+			nextMap:    *l.gameState.nextMap,
+			seed:       seed,
+		}
+		l.SendToPlayer(value, msg)
+	}
+	// spectators watch from the first seat
+	seats := PlayerMapToSlice(l.gameState.players)
+	l.SendToSpectators(LobbyMessage{
+		msgType:    LobbySendGameStart,
+		player:     seats[0],
+		allPlayers: seats,
+		walls:      WallStateRefToWallState(l.gameState.walls),
+		currentMap: *l.gameState.mapState,
+		nextMap:    *l.gameState.nextMap,
+		seed:       seed,
+	})
+	l.Log().Info("game started", "players", len(l.players), "seed", seed)
+	l.SetState(l.inturn)
+}
+
+// RecordReplay adds an event to the match's replay, if one is being recorded.
+func (l *Lobby) RecordReplay(event ReplayEvent) {
+	if l.replay != nil {
+		l.replay.Record(event)
+	}
+}
+
+// SaveReplay writes the finished match to the replay directory and stops
+// recording. The file is written off the lobby goroutine.
+func (l *Lobby) SaveReplay() {
+	if l.replay == nil {
+		return
+	}
+	replay := l.replay.Replay()
+	l.replay = nil
+	dir := l.hub.config.ReplayDir
+	if dir == "" {
+		return
+	}
+	log := l.Log().With("replay", replay.Header.ID)
+	go func() {
+		path, err := replay.Save(dir)
+		if err != nil {
+			log.Error("couldn't save the replay", "err", err)
+			return
+		}
+		log.Info("replay saved", "path", path, "events", len(replay.Events))
+	}()
+}
+
+// SaveResults hands the finished match to the store, which rates it. Like
+// the replay it is written in the background.
+func (l *Lobby) SaveResults() {
+	if l.replay == nil {
+		return
+	}
+	record := MatchRecord{
+		ID:         l.replay.ID(),
+		Lobby:      l.code,
+		Seed:       l.gameState.seed,
+		StartedAt:  l.startedAt,
+		FinishedAt: time.Now(),
+		Turns:      l.turnNumber,
+		Result:     l.result,
+	}
+	if l.result == "win" {
+		record.Winner = l.queue.Current().id
+	}
+	for _, s := range l.gameState.Standings() {
+		record.Players = append(record.Players, MatchPlayer{
+			PlayerID:     s.Id,
+			AccountID:    l.accounts[s.Id],
+			Username:     s.Username,
+			Placement:    s.Placement,
+			Knockouts:    s.Knockouts,
+			Turns:        l.gameState.players[s.Id].turnsPlayed,
+			EliminatedOn: s.EliminatedOn,
+			Shots:        s.Shots,
+			Distance:     s.Distance,
+		})
+	}
+	store := l.hub.store
+	log := l.Log().With("match", record.ID)
+	playerLogs := make(map[string]*slog.Logger, len(record.Players))
+	for _, p := range record.Players {
+		playerLogs[p.PlayerID] = l.LogFor(p.PlayerID).With("match", record.ID)
+	}
+	go func() {
+		record, err := store.RecordMatch(record)
+		if err != nil {
+			log.Error("couldn't save the match results", "err", err)
+			return
+		}
+		for _, p := range record.Players {
+			if p.AccountID != "" {
+				playerLogs[p.PlayerID].Info("rating updated", "account", p.AccountID, "placement", p.Placement, "rating", p.RatingAfter)
+			}
+		}
+	}()
+}
+
+// SimulationAckCount counts the players still in the turn queue who have
+// reported finishing the last shot's playback.
+func (l *Lobby) SimulationAckCount() int {
+	count := 0
+	for _, p := range l.queue.List() {
+		if l.simAcks[p.id] {
+			count++
+		}
+	}
+	return count
+}
+
+// SendSnapshot sends one player everything needed to redraw the lobby, and the
+// board too when a match is being played.
+func (l *Lobby) SendSnapshot(player *Player, inGame bool) {
+	msg := LobbyMessage{
+		msgType:   LobbySendSnapshot,
+		lobbyCode: l.code,
+		inGame:    inGame,
+	}
+	if inGame {
+		msg.currentMap = *l.gameState.mapState
+		msg.nextMap = *l.gameState.nextMap
+		msg.allPlayers = PlayerMapToSlice(l.gameState.players)
+		msg.walls = WallStateRefToWallState(l.gameState.walls)
+		msg.player = *l.gameState.players[l.queue.Current().id]
+		msg.turnNumber = l.turnNumber
+		for _, p := range l.queue.List() {
+			msg.turnOrder = append(msg.turnOrder, p.id)
+		}
+		for _, p := range l.eliminated {
+			msg.eliminatedPlayers = append(msg.eliminatedPlayers, *l.gameState.players[p.id])
+		}
+	}
+	l.SendToPlayer(player, msg)
+}
+
+func (l *Lobby) RejectPlayer(player *Player, reason string) {
+	l.LogFor(player.id).Info("turning away player", "reason", reason)
+	msg := LobbyMessage{
+		msgType:   LobbyRejectPlayer,
+		lobbyCode: l.code,
+		reason:    reason,
+	}
+	l.SendToPlayer(player, msg)
+}
+
+func (l *Lobby) RejectAction(player *Player, reason string) {
+	l.LogFor(player.id).Info("rejected a shot", "reason", reason)
+	msg := LobbyMessage{
+		msgType: LobbyRejectAction,
+		reason:  reason,
+	}
+	l.SendToPlayer(player, msg)
+}
+
+// Close asks the hub to forget this lobby and ends the Run loop. While it waits
+// for the hub it keeps draining readHub, since the hub may be blocked sending
+// to us at the same moment.
+func (l *Lobby) Close() {
+	l.StopTimer()
+	msg := LobbyMessage{
+		msgType:   LobbyClose,
+		lobbyCode: l.code,
+	}
+	for sent := false; !sent; {
+		select {
+		case l.hub.readLobby <- msg:
+			sent = true
+		case hm := <-l.readHub:
+			if hm.msgType == HubSendPlayerToLobby || hm.msgType == HubSendSpectatorToLobby {
+				l.RejectPlayer(hm.player, "lobby-closed")
+			}
+		}
+	}
+	l.RecordTransition(l.currentState, nil)
+	l.closed = true
+}
+
+// CloseForEveryone sends every player back to the hub and closes the lobby.
+func (l *Lobby) CloseForEveryone() {
+	msg := LobbyMessage{
+		msgType:   LobbyClose,
+		lobbyCode: l.code,
+	}
+	l.Broadcast(msg)
+	l.Close()
+}
+
+// RemovePlayer takes a player out of the lobby, passing ownership on if they
+// owned it. Once nobody is left the hub is asked to close the lobby; the
+// return value reports whether the lobby is still open.
+func (l *Lobby) RemovePlayer(player *Player) bool {
+	delete(l.players, player.id)
+	l.seats = slices.DeleteFunc(l.seats, func(p *Player) bool { return p == player })
+
+	if len(l.players) == 0 {
+		// only spectators can be left to tell
+		l.CloseForEveryone()
+		return false
+	}
+
+	if player == l.owner {
+		for _, value := range l.players {
+			l.owner = value
+			break
+		}
+		msg := LobbyMessage{
+			msgType: LobbySendMakeOwner,
+		}
+		l.SendToPlayer(l.owner, msg)
+	}
+	return true
+}
+
+// ForfeitPlayer removes a player who dropped out of a running match. If they
+// were still alive they are counted as eliminated and everyone else is told.
+func (l *Lobby) ForfeitPlayer(player *Player) bool {
+	l.LogFor(player.id).Info("player dropped out of the match")
+	open := l.RemovePlayer(player)
+	if l.queue.RemoveByID(player.id) {
+		l.gameState.players[player.id].alive = false
+		l.eliminated = append(l.eliminated, player)
+		l.gameState.players[player.id].eliminatedOn = l.turnNumber
+		l.RecordReplay(ReplayEvent{Type: ReplayForfeit, Turn: l.turnNumber, Player: player.id})
+		msg := LobbyMessage{
+			msgType:           LobbySendEliminations,
+			eliminatedPlayers: []PlayerIdentity{*l.gameState.players[player.id]},
+			turnNumber:        l.turnNumber,
+		}
+		l.Broadcast(msg)
+	}
+	return open
+}
+
 type LobbyState interface {
 	Enter(lobby *Lobby)
 	HandlePlayerMessage(pm PlayerMessage, channelOpen bool, lobby *Lobby)
 	HandleHubMessage(hm HubMessage, channelOpen bool, lobby *Lobby)
+	HandleTimeout(lobby *Lobby)
 	Exit(lobby *Lobby)
 }
 
 type LobbyWaitingForPlayers struct{}
 
 func (l LobbyWaitingForPlayers) Enter(lobby *Lobby) {
-	fmt.Println("we entered lobby waiting for players")
 	lobby.queue.Clear()
 	lobby.eliminated = []*Player{}
 }
@@ -223,56 +904,25 @@ func (l LobbyWaitingForPlayers) HandlePlayerMessage(pm PlayerMessage, channelOpe
 
 	switch pm.msgType {
 	case PlayerStartGame:
-		if pm.sender == lobby.owner.conn {
-			playerIDs := make([]string, 0, 10)
-			playerUsernames := make([]string, 0, 10)
-			for _, value := range lobby.players {
-				playerIDs = append(playerIDs, value.id)
-				playerUsernames = append(playerUsernames, value.username)
-			}
-			lobby.gameState = GetNewGame(playerIDs, playerUsernames)
-			// initialize the turn queue
-			for _, value := range lobby.players {
-				lobby.queue.Add(value)
-			}
-
-			for _, value := range lobby.players { //sending the message to all players
-				msg := LobbyMessage{
-					msgType:    LobbySendGameStart,
-					player:     *lobby.gameState.players[value.id],
-					allPlayers: PlayerMapToSlice(lobby.gameState.players),
-					walls:      WallStateRefToWallState(lobby.gameState.walls),
-					currentMap: *lobby.gameState.mapState,
-					nextMap:    *lobby.gameState.nextMap,
-				}
-				value.readLobby <- msg
-			}
-			lobby.SetState(lobby.inturn)
-		} else if pm.sender != lobby.owner.conn {
-			fmt.Println("only the party owner can start the match")
+		if pm.player == lobby.owner && len(lobby.players) < lobby.hub.config.MinLobbyPlayers {
+			lobby.Log().Info("not enough players to start the match", "players", len(lobby.players))
 			return
 		}
-
-	case PlayerLeaveRoom:
-		fmt.Println("some brudda just left the room....  THIS BURDDA:  ", pm.senderID)
-		delete(lobby.players, pm.sender)
-
-		if lobby.queue.Size() == 0 {
-			msg := LobbyMessage{
-				msgType:   LobbyClose,
-				lobbyCode: lobby.code,
-			}
-			lobby.hub.readLobby <- msg
+		if pm.player == lobby.owner {
+			lobby.StartGame(pm.msg.Seed)
+		} else {
+			lobby.LogFor(pm.senderID).Info("only the party owner can start the match")
 			return
 		}
 
-		if pm.player == lobby.owner {
-			lobby.owner = lobby.queue.Current()
-			msg := LobbyMessage{
-				msgType: LobbySendMakeOwner,
-			}
-			lobby.owner.readLobby <- msg
-		}
+	case PlayerLeaveRoom:
+		lobby.LogFor(pm.senderID).Info("player left the room")
+		lobby.RemovePlayer(pm.player)
+	case PlayerDisconnected:
+		lobby.LogFor(pm.senderID).Info("player disconnected while waiting in the lobby")
+		lobby.RemovePlayer(pm.player)
+	case PlayerRequestSnapshot:
+		lobby.SendSnapshot(pm.player, false)
 	}
 }
 func (l LobbyWaitingForPlayers) HandleHubMessage(hm HubMessage, channelOpen bool, lobby *Lobby) {
@@ -280,11 +930,27 @@ func (l LobbyWaitingForPlayers) HandleHubMessage(hm HubMessage, channelOpen bool
 	}
 
 	switch hm.msgType {
+	case HubShutdown:
+		lobby.CloseForEveryone()
 	case HubSendPlayerToLobby:
-		lobby.players[hm.player.conn] = hm.player
+		if len(lobby.players) >= lobby.hub.config.MaxLobbyPlayers {
+			lobby.RejectPlayer(hm.player, "lobby-full")
+			return
+		}
+		lobby.players[hm.player.id] = hm.player
+		lobby.seats = append(lobby.seats, hm.player)
+		lobby.LogFor(hm.player.id).Info("player joined")
+		msg := LobbyMessage{
+			msgType:   LobbyAcceptPlayer,
+			lobbyCode: lobby.code,
+			token:     lobby.hub.StartSession(hm.player, lobby.code),
+			lobby:     lobby,
+		}
+		lobby.SendToPlayer(hm.player, msg)
 	}
 }
-func (l LobbyWaitingForPlayers) Exit(lobby *Lobby) {}
+func (l LobbyWaitingForPlayers) HandleTimeout(lobby *Lobby) {}
+func (l LobbyWaitingForPlayers) Exit(lobby *Lobby)          {}
 
 type LobbyInTurn struct{}
 
@@ -297,215 +963,226 @@ func (l LobbyInTurn) Enter(lobby *Lobby) {
 		walls:      nil,
 	}
 	player := lobby.queue.Current()
-	player.turnsPlayed++
-	fmt.Println("sending a turn start message to: ", player.id)
-	player.readLobby <- msg
+	identity := lobby.gameState.players[player.id]
+	identity.turnsPlayed++
+	lobby.gameState.lastShot = ShotRecord{}
+	lobby.turnNumber++
+	lobby.RecordReplay(ReplayEvent{Type: ReplayTurnStart, Turn: lobby.turnNumber, Player: player.id})
+	lobby.LogFor(player.id).Debug("turn started", "turns_played", identity.turnsPlayed)
+	lobby.SendToPlayer(player, msg)
+	lobby.StartTimer(lobby.gameState.turnTimer)
 }
 func (l LobbyInTurn) HandlePlayerMessage(pm PlayerMessage, channelOpen bool, lobby *Lobby) {
 	if !channelOpen {
 	}
 	switch pm.msgType {
 	case PlayerSendAction:
-		fmt.Println("PLAYA sent an action")
-		if pm.sender == lobby.queue.Current().conn {
+		if pm.player == lobby.queue.Current() {
+			// a bad shot doesn't cost the turn, the player can try again until the timer runs out
+			if reason := ValidatePlayerAction(pm.msg.Action); reason != "" {
+				lobby.RejectAction(pm.player, reason)
+				return
+			}
+			move := LobbyMessage{
+				msgType: LobbyBroadcastMove,
+				player:  *lobby.gameState.players[pm.player.id],
+				action:  pm.msg.Action,
+			}
 			for _, value := range lobby.players {
 				if pm.player.id != value.id {
-					fmt.Println("BROADCASTING MOVE")
-					msg := LobbyMessage{
-						msgType: LobbyBroadcastMove,
-						player:  *lobby.gameState.players[pm.player.id],
-						action:  pm.msg.Action,
-					}
-					value.readLobby <- msg
+					lobby.SendToPlayer(value, move)
 				}
 			}
-			tools.PhysicsResolver(lobby.gameState.players[pm.senderID].circle, PlayerMapToCircles(lobby.gameState.players), GetWallRectRefs(lobby.gameState.walls), PlayerActionToShotData(pm.msg.Action))
-			for _, value := range lobby.players {
-				fmt.Println("Sending entity update message to: ", value.id)
-				//turn the active queue into a list, then get them playeridentities
-				activePlayers := append([]*Player{}, lobby.queue.List()...)
-				activePlayerIDs := make([]PlayerIdentity, 0, 10)
-				for i := range activePlayers {
-					activePlayerIDs = append(activePlayerIDs, *lobby.gameState.players[activePlayers[i].id])
+			lobby.SendToSpectators(move)
+			started := time.Now()
+			identities := PlayerMapToSliceRef(lobby.gameState.players)
+			options := tools.ResolverOptions{RecordEvery: lobby.hub.config.TrajectoryEvery}
+			shot := tools.PhysicsResolver(lobby.gameState.players[pm.senderID].circle, IdentitiesToCircles(identities), GetWallRectRefs(lobby.gameState.walls), PlayerActionToShotData(pm.msg.Action), options)
+			lobby.gameState.RecordShot(pm.senderID, identities, shot)
+			action := pm.msg.Action
+			lobby.RecordReplay(ReplayEvent{Type: ReplayShot, Turn: lobby.turnNumber, Player: pm.senderID, Action: &action, Players: FormatPlayerIds(PlayerMapToSlice(lobby.gameState.players))})
+			if options.RecordEvery > 0 {
+				msg := LobbyMessage{
+					msgType:    LobbySendTrajectory,
+					trajectory: NewShotTrajectory(pm.senderID, identities, options.RecordEvery, shot),
 				}
+				lobby.Broadcast(msg)
+			}
+			activePlayerIDs := lobby.ActivePlayerIdentities()
+			for _, value := range lobby.players {
 				msg := LobbyMessage{
 					msgType:    LobbySendEntityUpdate,
 					player:     *lobby.gameState.players[value.id],
 					allPlayers: activePlayerIDs,
 					walls:      WallStateRefToWallState(lobby.gameState.walls),
 				}
-				value.readLobby <- msg
+				lobby.SendToPlayer(value, msg)
 			}
+			lobby.SendToSpectators(LobbyMessage{
+				msgType:    LobbySendEntityUpdate,
+				player:     *lobby.gameState.players[pm.senderID],
+				allPlayers: activePlayerIDs,
+				walls:      WallStateRefToWallState(lobby.gameState.walls),
+			})
 
+			lobby.hub.metrics.ShotResolved(shot.Steps, time.Since(started))
+			lobby.settleTime = SimulationSettleTime(shot.Steps)
+			lobby.LogFor(pm.senderID).Debug("shot simulated", "steps", shot.Steps, "contacts", len(shot.Contacts), "wall_bounces", len(shot.WallBounces), "settle_time", lobby.settleTime)
 			lobby.SetState(lobby.processingturn)
 		} else {
-			fmt.Println("the guy who send the move doesnt seem to match with the guy who should be the one sendinrgirngrihafug")
-			fmt.Println("sender ID: ", pm.sender)
-			fmt.Println("active guy ID: ", lobby.queue.Current().conn)
+			lobby.LogFor(pm.senderID).Warn("shot from a player whose turn it isn't", "current", lobby.queue.Current().id)
+			lobby.RejectAction(pm.player, "not-your-turn")
 		}
 	case PlayerSendWall:
-		if pm.sender == lobby.queue.Current().conn {
-			newWall := pm.msg.Wall
-			lobby.gameState.walls = append(lobby.gameState.walls, &newWall)
-			for _, value := range lobby.players {
-				msg := LobbyMessage{
-					msgType:    LobbySendWallUpdate,
-					player:     *lobby.gameState.players[value.id],
-					allPlayers: PlayerMapToSlice(lobby.gameState.players),
-					walls:      WallStateRefToWallState(lobby.gameState.walls),
-				}
-				value.readLobby <- msg
-			}
+		if pm.player != lobby.queue.Current() {
+			lobby.RejectAction(pm.player, "not-your-turn")
+			return
+		}
+		// only the position comes from the client, the server decides the rest
+		wall := NewWallState(pm.msg.Wall.PositionX, pm.msg.Wall.PositionY, pm.senderID)
+		if reason := lobby.gameState.PlaceWall(wall); reason != "" {
+			lobby.RejectAction(pm.player, reason)
+			return
+		}
+		lobby.LogFor(pm.senderID).Debug("wall placed", "x", wall.PositionX, "y", wall.PositionY)
+		placed := *wall
+		lobby.RecordReplay(ReplayEvent{Type: ReplayWall, Turn: lobby.turnNumber, Player: pm.senderID, Wall: &placed})
+		lobby.BroadcastWalls()
+	case PlayerDisconnected:
+		wasCurrent := lobby.queue.Current() == pm.player
+		if !lobby.ForfeitPlayer(pm.player) {
+			return
+		}
+		if !lobby.CheckForGameOver() && wasCurrent {
+			lobby.SetState(lobby.inturn)
 		}
+	case PlayerRequestSnapshot:
+		lobby.SendSnapshot(pm.player, true)
+	}
+}
+func (l LobbyInTurn) HandleHubMessage(hm HubMessage, channelOpen bool, lobby *Lobby) {
+	switch hm.msgType {
+	case HubSendPlayerToLobby:
+		lobby.RejectPlayer(hm.player, "game-in-progress")
+	case HubShutdown:
+		lobby.CloseForEveryone()
 	}
 }
-func (l LobbyInTurn) HandleHubMessage(hm HubMessage, channelOpen bool, lobby *Lobby) {}
-func (l LobbyInTurn) Exit(lobby *Lobby)                                              {}
+
+// the active player ran out of time: let everyone know and end the turn as if
+// they had passed.
+func (l LobbyInTurn) HandleTimeout(lobby *Lobby) {
+	player := lobby.queue.Current()
+	lobby.LogFor(player.id).Info("turn timed out")
+	lobby.RecordReplay(ReplayEvent{Type: ReplayTurnTimeout, Turn: lobby.turnNumber, Player: player.id})
+	msg := LobbyMessage{
+		msgType: LobbySendTurnTimeout,
+		player:  *lobby.gameState.players[player.id],
+	}
+	lobby.Broadcast(msg)
+	// a skipped turn still counts towards shrinking the arena
+	lobby.EndTurn()
+}
+func (l LobbyInTurn) Exit(lobby *Lobby) { lobby.StopTimer() }
 
 type LobbyProcessingTurn struct{}
 
+// the server already knows how the shot ends, so the turn advances once the
+// clients have had time to play it back. Acks only let it advance sooner.
 func (l LobbyProcessingTurn) Enter(lobby *Lobby) {
-	lobby.simCount = 0
+	lobby.simAcks = make(map[string]bool)
+	lobby.StartTimer(lobby.settleTime)
 }
 func (l LobbyProcessingTurn) HandlePlayerMessage(pm PlayerMessage, channelOpen bool, lobby *Lobby) {
 	if !channelOpen {
 	}
 	switch pm.msgType {
 	case PlayerSimulationDone:
-		lobby.simCount++
-		fmt.Println("simCount is: ", lobby.simCount, " and the no. of players are: ", lobby.queue.Size())
-		if lobby.simCount >= lobby.queue.Size() {
-			//eliminate the dead players...
-			//first we shrink the map if 4turns/8turns have happened
-			minTurns := lobby.queue.List()[0].turnsPlayed
-			for _, p := range lobby.queue.List() {
-				if p.turnsPlayed < minTurns {
-					minTurns = p.turnsPlayed
-				}
-			}
-
-			if minTurns == 3 {
-				fmt.Println("sending map update blyat")
-				nextMap := tools.ShrinkArena(lobby.gameState.nextMap)
-				lobby.gameState.mapState = lobby.gameState.nextMap
-				lobby.gameState.nextMap = nextMap
-				msg := LobbyMessage{
-					msgType:    LobbySendMapUpdate,
-					currentMap: *lobby.gameState.mapState,
-					nextMap:    *lobby.gameState.nextMap,
-				}
-				for _, value := range lobby.players {
-					value.readLobby <- msg
-				}
-			}
-			if minTurns == 5 {
-				//apply the shrinkmap
-				lobby.gameState.mapState = lobby.gameState.nextMap
-				msg := LobbyMessage{
-					msgType:    LobbySendMapUpdate,
-					currentMap: *lobby.gameState.mapState,
-					nextMap:    *lobby.gameState.nextMap,
-				}
-				for _, value := range lobby.players {
-					value.readLobby <- msg
-				}
-			}
-			eliminated := lobby.Eliminate()
-			if len(eliminated) != 0 {
-				//some1 dead
-				msg := LobbyMessage{
-					msgType:           LobbySendEliminations,
-					eliminatedPlayers: eliminated,
-				}
-				for _, value := range lobby.players {
-					value.readLobby <- msg
-				}
-
-			} else {
-				fmt.Println("everybody lived this turn")
-			}
-			if lobby.queue.Size() == 0 {
-				//we have a draw
-				msg := LobbyMessage{
-					msgType:    LobbySendGameOver,
-					result:     "draw",
-					winnerName: "",
-				}
-				for _, value := range lobby.players {
-					value.readLobby <- msg
-				}
-				lobby.SetState(lobby.gameOver)
-
-			} else if lobby.queue.Size() == 1 {
-				//ladies and gentlemen we have a winner
-				msg := LobbyMessage{
-					msgType:    LobbySendGameOver,
-					result:     "win",
-					winnerName: lobby.queue.Current().username,
-				}
-				for _, value := range lobby.players {
-					value.readLobby <- msg
-				}
-				lobby.SetState(lobby.gameOver)
-			} else {
-				lobby.SetState(lobby.inturn)
-			}
-
+		lobby.simAcks[pm.player.id] = true
+		lobby.LogFor(pm.senderID).Debug("simulation ack", "acks", lobby.SimulationAckCount(), "players", lobby.queue.Size())
+		if lobby.SimulationAckCount() >= lobby.queue.Size() {
+			lobby.EndTurn()
 		}
+	case PlayerDisconnected:
+		if !lobby.ForfeitPlayer(pm.player) {
+			return
+		}
+		// the dropped player may have been the last ack we were waiting on
+		if lobby.queue.Size() < 2 {
+			lobby.CheckForGameOver()
+		} else if lobby.SimulationAckCount() >= lobby.queue.Size() {
+			lobby.EndTurn()
+		}
+	case PlayerRequestSnapshot:
+		lobby.SendSnapshot(pm.player, true)
+	}
+}
+func (l LobbyProcessingTurn) HandleHubMessage(hm HubMessage, channelOpen bool, lobby *Lobby) {
+	switch hm.msgType {
+	case HubSendPlayerToLobby:
+		lobby.RejectPlayer(hm.player, "game-in-progress")
+	case HubShutdown:
+		// a shot is playing out, let it land before closing
+		lobby.shuttingDown = true
 	}
 }
-func (l LobbyProcessingTurn) HandleHubMessage(hm HubMessage, channelOpen bool, lobby *Lobby) {}
-func (l LobbyProcessingTurn) Exit(lobby *Lobby)                                              { lobby.simCount = 0 }
+
+// every client should have finished playing the shot back by now.
+func (l LobbyProcessingTurn) HandleTimeout(lobby *Lobby) {
+	lobby.Log().Debug("settle time passed", "acks", lobby.SimulationAckCount(), "players", lobby.queue.Size())
+	lobby.EndTurn()
+}
+func (l LobbyProcessingTurn) Exit(lobby *Lobby) {
+	lobby.StopTimer()
+	lobby.simAcks = make(map[string]bool)
+}
 
 type LobbyGameOver struct{}
 
-func (l LobbyGameOver) Enter(lobby *Lobby) {
-	fmt.Println("entering lobby game voer state")
-}
+func (l LobbyGameOver) Enter(lobby *Lobby) {}
 func (l LobbyGameOver) HandlePlayerMessage(pm PlayerMessage, channelOpen bool, lobby *Lobby) {
 	//you can either quit to main menu, or if you are the party leader you can take eveyone to the lobby screen.
-	if pm.msgType == PlayerReturnToMainMenu {
-		fmt.Println("some brudda just quit to main menu....  THIS BURDDA:  ", pm.senderID)
-		delete(lobby.players, pm.sender)
+	if pm.msgType == PlayerReturnToMainMenu || pm.msgType == PlayerDisconnected {
+		lobby.LogFor(pm.senderID).Info("player quit to main menu")
+		delete(lobby.players, pm.senderID)
+		lobby.seats = slices.DeleteFunc(lobby.seats, func(p *Player) bool { return p == pm.player })
 		lobby.queue.RemoveByID(pm.senderID)
 
-		if lobby.queue.Size() == 0 {
-			msg := LobbyMessage{
-				msgType:   LobbyClose,
-				lobbyCode: lobby.code,
-			}
-			lobby.hub.readLobby <- msg
+		if len(lobby.players) == 0 {
+			lobby.CloseForEveryone()
 			return
 		}
 
 		if pm.player == lobby.owner {
 			//send everyone to the main menu and close the lobby.
 			//send a lobby close message to the hub and the player
-			msg := LobbyMessage{
-				msgType:   LobbyClose,
-				lobbyCode: lobby.code,
-			}
-			for _, value := range lobby.players {
-				value.readLobby <- msg
-			}
-			lobby.hub.readLobby <- msg
+			lobby.CloseForEveryone()
 		}
 	}
 
 	if pm.msgType == PlayerReturnToLobby {
-		fmt.Println("recieved a player return to lobby msg")
 		if pm.player == lobby.owner {
 			msg := LobbyMessage{
 				msgType: LobbySendPlayerToLobby,
 			}
-			for _, value := range lobby.players {
-				value.readLobby <- msg
-			}
-			fmt.Println("goin tp waiting for players")
+			lobby.Broadcast(msg)
+			lobby.Log().Info("owner took everyone back to the lobby")
 			lobby.SetState(lobby.waitingforplayers)
 		}
 	}
 
+	if pm.msgType == PlayerRequestSnapshot {
+		lobby.SendSnapshot(pm.player, false)
+	}
+
+}
+func (l LobbyGameOver) HandleHubMessage(hm HubMessage, channelOpen bool, lobby *Lobby) {
+	switch hm.msgType {
+	case HubSendPlayerToLobby:
+		lobby.RejectPlayer(hm.player, "game-in-progress")
+	case HubShutdown:
+		lobby.CloseForEveryone()
+	}
 }
-func (l LobbyGameOver) HandleHubMessage(hm HubMessage, channelOpen bool, lobby *Lobby) {}
-func (l LobbyGameOver) Exit(lobby *Lobby)                                              {}
+func (l LobbyGameOver) HandleTimeout(lobby *Lobby) {}
+func (l LobbyGameOver) Exit(lobby *Lobby)          {}
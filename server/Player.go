@@ -1,15 +1,25 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"log/slog"
 	"math/rand"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+const (
+	OUTBOUND_QUEUE_SIZE   = 64 // server messages waiting for the write pump
+	LOBBY_QUEUE_SIZE      = 64 // lobby messages waiting for the player goroutine
+	WRITE_WAIT_IN_SECONDS = 10
+	PONG_WAIT_IN_SECONDS  = 30 // default window for a pong before the peer counts as dead
+)
+
 type PlayerMessageType int
 
 const (
@@ -22,6 +32,16 @@ const (
 	PlayerCreateRoom
 	PlayerReturnToMainMenu
 	PlayerReturnToLobby
+	PlayerDisconnected
+	PlayerEndSession
+	PlayerRequestSnapshot
+	PlayerConnected
+	PlayerJoinAsSpectator
+	PlayerQuickPlay
+	PlayerJoinQueue
+	PlayerLeaveQueue
+	PlayerReadyAccept
+	PlayerReadyDecline
 )
 
 type PlayerMessage struct {
@@ -30,6 +50,8 @@ type PlayerMessage struct {
 	sender   *websocket.Conn
 	senderID string
 	msg      ClientMessage
+	skip     []string // quick play: lobbies that already turned the player away
+	rating   float64  // join-queue: the rating to match the player on
 }
 
 /*
@@ -50,11 +72,15 @@ type PlayerState interface {
 
 type PlayerInHub struct{}
 
-func (p *PlayerInHub) Enter(player *Player) {}
+func (p *PlayerInHub) Enter(player *Player) {
+	player.lobby = nil
+}
 
 func (p *PlayerInHub) HandleClientMessage(cm ClientMessage, channelOpen bool, player *Player) {
 	if !channelOpen {
 		// the player <- client channel has been closed.
+		player.Disconnect()
+		return
 	}
 
 	switch cm.Type {
@@ -66,7 +92,7 @@ func (p *PlayerInHub) HandleClientMessage(cm ClientMessage, channelOpen bool, pl
 			senderID: player.id,
 			msg:      cm,
 		}
-		player.username = cm.Username
+		player.SetUsername(cm.Username)
 		player.hub.readPlayer <- msg
 		player.SetState(&PlayerRequestedForLobby{})
 	case ClientJoinRoom:
@@ -77,26 +103,104 @@ func (p *PlayerInHub) HandleClientMessage(cm ClientMessage, channelOpen bool, pl
 			senderID: player.id,
 			msg:      cm,
 		}
-		player.username = cm.Username
+		player.SetUsername(cm.JoinData.Username)
+		player.hub.readPlayer <- msg
+		player.SetState(&PlayerRequestedForLobby{})
+	case ClientListLobbies:
+		// asked the way GET /lobbies asks, so the hub never has to wait on
+		// this player's queue to answer however fast the client asks
+		reply := make(chan []LobbyInfo, 1)
+		player.hub.readList <- reply
+		player.WriteToClient(newLobbyListMessage(<-reply), player.id)
+	case ClientQuickPlay:
+		msg := PlayerMessage{
+			msgType:  PlayerQuickPlay,
+			player:   player,
+			sender:   player.conn,
+			senderID: player.id,
+			msg:      cm,
+		}
+		player.SetUsername(cm.Username)
+		player.hub.readPlayer <- msg
+		player.SetState(&PlayerRequestedForLobby{quickPlay: true})
+	case ClientJoinQueue:
+		msg := PlayerMessage{
+			msgType:  PlayerJoinQueue,
+			player:   player,
+			sender:   player.conn,
+			senderID: player.id,
+			msg:      cm,
+		}
+		player.SetUsername(cm.Username)
+		msg.rating = player.Rating()
+		player.hub.matchmaker.readPlayer <- msg
+		player.SetState(&PlayerInQueue{})
+	case ClientRegister, ClientLogin, ClientGuestLogin:
+		player.LogIn(cm)
+	case ClientJoinAsSpectator:
+		msg := PlayerMessage{
+			msgType:  PlayerJoinAsSpectator,
+			player:   player,
+			sender:   player.conn,
+			senderID: player.id,
+			msg:      cm,
+		}
+		player.SetUsername(cm.JoinData.Username)
 		player.hub.readPlayer <- msg
 		player.SetState(&PlayerRequestedForLobby{})
 	}
 }
 
-func (p *PlayerInHub) HandleLobbyMessage(lm LobbyMessage, channelOpen bool, player *Player) {}
+// a player who left the match queue just as their group was matched can still
+// be seated by the lobby the hub opened for it.
+func (p *PlayerInHub) HandleLobbyMessage(lm LobbyMessage, channelOpen bool, player *Player) {
+	player.TurnDownSeat(lm)
+}
 
 func (p *PlayerInHub) HandleHubMessage(hm HubMessage, channelOpen bool, player *Player) {}
 
 func (p *PlayerInHub) Exit() {}
 
-type PlayerRequestedForLobby struct{}
+type PlayerRequestedForLobby struct {
+	quickPlay  bool
+	turnedAway []string // lobbies that turned this quick play down
+}
 
 func (p *PlayerRequestedForLobby) Enter(player *Player) {}
 
 func (p *PlayerRequestedForLobby) HandleClientMessage(cm ClientMessage, channelOpen bool, player *Player) {
+	// if the socket closes here we still have to wait for the answer to our
+	// request, otherwise its sender would block. CheckSocket finishes the job.
 }
 
+// joins are answered by the lobby itself, since only it knows whether it has room.
 func (p *PlayerRequestedForLobby) HandleLobbyMessage(lm LobbyMessage, channelOpen bool, player *Player) {
+	switch lm.msgType {
+	case LobbyAcceptPlayer:
+		player.WriteToClient(newRoomJoinedMessage(lm.lobbyCode, lm.token), player.id)
+		player.SetState(&PlayerInLobby{l: lm.lobby})
+	case LobbyAcceptSpectator:
+		player.WriteToClient(newSpectatingMessage(lm.lobbyCode, lm.token), player.id)
+		player.SetState(&PlayerSpectating{l: lm.lobby})
+	case LobbyRejectPlayer:
+		if p.quickPlay && !player.socketClosed {
+			// the hub's list was stale and the lobby filled up or started, try the next one
+			player.Log().Info("quick play lobby turned us away, trying another", "turned_away_by", lm.lobbyCode, "reason", lm.reason)
+			p.turnedAway = append(p.turnedAway, lm.lobbyCode)
+			player.hub.readPlayer <- PlayerMessage{
+				msgType:  PlayerQuickPlay,
+				player:   player,
+				sender:   player.conn,
+				senderID: player.id,
+				skip:     slices.Clone(p.turnedAway),
+			}
+			return
+		}
+		player.WriteToClient(newJoinRejectedMessage(lm.reason), player.id)
+		player.SetState(&PlayerInHub{})
+	}
+
+	p.CheckSocket(player)
 }
 
 func (p *PlayerRequestedForLobby) HandleHubMessage(hm HubMessage, channelOpen bool, player *Player) {
@@ -105,16 +209,28 @@ func (p *PlayerRequestedForLobby) HandleHubMessage(hm HubMessage, channelOpen bo
 	}
 
 	switch hm.msgType {
-	case HubSendPlayerToLobby:
-		player.WriteToClient(newRoomJoinedMessage(), player.id)
-		player.SetState(&PlayerInLobby{l: hm.lobby})
 	case HubRoomCreated:
-		fmt.Println("writeing to player rn that room has been created")
-		player.WriteToClient(newRoomCreatedMessage(hm.code), player.id)
+		player.WriteToClient(newRoomCreatedMessage(hm.code, hm.token), player.id)
 		player.SetState(&PlayerInLobby{l: hm.lobby})
 	case HubPlayerInvalidCode:
 		player.WriteToClient(newInvalidCodeMessage(), player.id)
 		player.SetState(&PlayerInHub{})
+	case HubServerShuttingDown:
+		player.SetState(&PlayerInHub{})
+	}
+
+	p.CheckSocket(player)
+}
+
+// CheckSocket deals with a socket that closed while we were waiting for an
+// answer, once we know whether we ended up in a lobby.
+func (p *PlayerRequestedForLobby) CheckSocket(player *Player) {
+	if player.socketClosed {
+		if player.lobby != nil {
+			player.WaitForResume()
+		} else {
+			player.Disconnect()
+		}
 	}
 }
 
@@ -130,18 +246,20 @@ func (p *PlayerInLobby) Enter(player *Player) {
 
 func (p *PlayerInLobby) HandleClientMessage(cm ClientMessage, channelOpen bool, player *Player) {
 	if !channelOpen {
-		//
+		player.WaitForResume()
+		return
 	}
 
 	switch cm.Type {
 	case ClientStartGame:
 		msg := PlayerMessage{
 			msgType:  PlayerStartGame,
+			player:   player,
 			sender:   player.conn,
 			senderID: player.id,
 			msg:      cm,
 		}
-		player.lobby.Inbound <- msg
+		player.SendToLobby(msg)
 	case ClientLeaveRoom:
 		msg := PlayerMessage{
 			msgType:  PlayerLeaveRoom,
@@ -150,7 +268,7 @@ func (p *PlayerInLobby) HandleClientMessage(cm ClientMessage, channelOpen bool,
 			senderID: player.id,
 			msg:      cm,
 		}
-		player.lobby.Inbound <- msg
+		player.SendToLobby(msg)
 		player.SetState(&PlayerInHub{})
 	}
 }
@@ -161,20 +279,23 @@ func (p *PlayerInLobby) HandleLobbyMessage(lm LobbyMessage, channelOpen bool, pl
 	}
 	switch lm.msgType {
 	case LobbySendGameStart:
-		fmt.Println("[PLAYER IN LOBBY] sending player a game-start message")
 		otherPlayers := make([]PlayerIdentity, 0)
 		for i := range lm.allPlayers {
 			if lm.allPlayers[i].id != lm.player.id {
 				otherPlayers = append(otherPlayers, lm.allPlayers[i])
 			}
 		}
-		msg := newGameStartMessage(lm.currentMap, lm.nextMap, lm.player, otherPlayers)
+		msg := newGameStartMessage(lm.currentMap, lm.nextMap, lm.player, otherPlayers, lm.seed)
 		player.WriteToClient(msg, player.id)
 		player.SetState(&PlayerInGame{})
 	case LobbySendMakeOwner:
-		fmt.Println("[PLAYER IN LOBBY] sending player a make owner message")
 		msg := newMakeOwnerMessage()
 		player.WriteToClient(msg, player.id)
+	case LobbyClose:
+		player.WriteToClient(newLobbyClosedMessage(), player.id)
+		player.SetState(&PlayerInHub{})
+	case LobbySendSnapshot:
+		player.WriteToClient(newStateSnapshotMessage(lm.lobbyCode, lm.inGame, lm.currentMap, lm.nextMap, lm.allPlayers, lm.walls, lm.player.id, lm.turnOrder, lm.eliminatedPlayers, lm.turnNumber), player.id)
 	}
 }
 
@@ -189,15 +310,13 @@ func (p *PlayerInGame) Enter(player *Player) {}
 func (p *PlayerInGame) HandleClientMessage(cm ClientMessage, channelOpen bool, player *Player) {
 	if !channelOpen {
 		//the channel that recieves messages from the client has been closed, handle this accordingly
+		player.WaitForResume()
+		return
 	}
 
 	switch cm.Type {
-	case ClientCreateRoom:
-		fmt.Println("cannot create room while player is already ingame")
-	case ClientJoinRoom:
-		fmt.Println("cannot join room while player is already ingame")
-	case ClientStartGame:
-		fmt.Println("cannot start game while player is already ingame")
+	case ClientCreateRoom, ClientJoinRoom, ClientStartGame:
+		player.Log().Debug("ignoring a message the player can't send mid-game", "type", cm.Type)
 	case ClientSendTurn:
 		playerMsg := PlayerMessage{
 			msgType:  PlayerSendAction,
@@ -207,19 +326,27 @@ func (p *PlayerInGame) HandleClientMessage(cm ClientMessage, channelOpen bool, p
 			msg:      cm,
 		}
 
-		player.lobby.Inbound <- playerMsg
+		player.SendToLobby(playerMsg)
 	case ClientSendWall:
 		playerMsg := PlayerMessage{
-			msgType: PlayerSendWall,
-			msg:     cm,
+			msgType:  PlayerSendWall,
+			player:   player,
+			sender:   player.conn,
+			senderID: player.id,
+			msg:      cm,
 		}
 
-		player.lobby.Inbound <- playerMsg
+		player.SendToLobby(playerMsg)
 	case ClientSimulationDone:
 		playerMsg := PlayerMessage{
-			msgType: PlayerSimulationDone,
+			msgType:  PlayerSimulationDone,
+			player:   player,
+			sender:   player.conn,
+			senderID: player.id,
 		}
-		player.lobby.Inbound <- playerMsg
+		player.SendToLobby(playerMsg)
+	case ClientRequestResync:
+		player.RequestSnapshot()
 	}
 }
 
@@ -242,18 +369,29 @@ func (p *PlayerInGame) HandleLobbyMessage(lm LobbyMessage, channelOpen bool, pla
 		serverMsg := newTurnStartMessage(lm.player.id)
 		player.WriteToClient(serverMsg, player.id)
 	case LobbySendTurnTimeout:
-		serverMsg := newTurnTimeoutMessage()
+		serverMsg := newTurnTimeoutMessage(lm.player.id)
 		player.WriteToClient(serverMsg, player.id)
+	case LobbySendTrajectory:
+		player.WriteToClient(newShotTrajectoryMessage(lm.trajectory), player.id)
+	case LobbyRejectAction:
+		player.WriteToClient(newActionRejectedMessage(lm.reason), player.id)
 	case LobbyBroadcastMove:
 		serverMsg := newBroadcastTurnMessage(lm.player, lm.action)
 		player.WriteToClient(serverMsg, player.id)
 	case LobbySendEliminations:
-		serverMsg := newEliminationMessage(lm.eliminatedPlayers)
+		serverMsg := newEliminationMessage(lm.eliminatedPlayers, lm.turnNumber)
 		player.WriteToClient(serverMsg, player.id)
 	case LobbySendGameOver:
-		serverMsg := newGameFinishedMessage(lm.result, lm.winnerName)
+		serverMsg := newGameFinishedMessage(lm.result, lm.winnerName, lm.kills, lm.standings)
 		player.WriteToClient(serverMsg, player.id)
 		player.SetState(&PlayerGameOver{})
+	case LobbySendMakeOwner:
+		player.WriteToClient(newMakeOwnerMessage(), player.id)
+	case LobbyClose:
+		player.WriteToClient(newLobbyClosedMessage(), player.id)
+		player.SetState(&PlayerInHub{})
+	case LobbySendSnapshot:
+		player.WriteToClient(newStateSnapshotMessage(lm.lobbyCode, lm.inGame, lm.currentMap, lm.nextMap, lm.allPlayers, lm.walls, lm.player.id, lm.turnOrder, lm.eliminatedPlayers, lm.turnNumber), player.id)
 	}
 }
 
@@ -266,6 +404,11 @@ type PlayerGameOver struct{}
 func (p *PlayerGameOver) Enter(player *Player) {}
 
 func (p *PlayerGameOver) HandleClientMessage(cm ClientMessage, channelOpen bool, player *Player) {
+	if !channelOpen {
+		player.WaitForResume()
+		return
+	}
+
 	//return to lobby and return to mainmenu
 	switch cm.Type {
 	case ClientReturnToLobby:
@@ -275,7 +418,7 @@ func (p *PlayerGameOver) HandleClientMessage(cm ClientMessage, channelOpen bool,
 			sender:   player.conn,
 			senderID: player.id,
 		}
-		player.lobby.Inbound <- msg
+		player.SendToLobby(msg)
 	case ClientReturnToMainMenu:
 		msg := PlayerMessage{
 			msgType:  PlayerReturnToMainMenu,
@@ -283,7 +426,7 @@ func (p *PlayerGameOver) HandleClientMessage(cm ClientMessage, channelOpen bool,
 			sender:   player.conn,
 			senderID: player.id,
 		}
-		player.lobby.Inbound <- msg
+		player.SendToLobby(msg)
 		player.SetState(&PlayerInHub{})
 	}
 }
@@ -299,6 +442,10 @@ func (p *PlayerGameOver) HandleLobbyMessage(lm LobbyMessage, channelOpen bool, p
 		serverMsg := newLobbyClosedMessage()
 		player.WriteToClient(serverMsg, player.id)
 		player.SetState(&PlayerInHub{})
+	case LobbySendMakeOwner:
+		player.WriteToClient(newMakeOwnerMessage(), player.id)
+	case LobbySendSnapshot:
+		player.WriteToClient(newStateSnapshotMessage(lm.lobbyCode, lm.inGame, lm.currentMap, lm.nextMap, lm.allPlayers, lm.walls, lm.player.id, lm.turnOrder, lm.eliminatedPlayers, lm.turnNumber), player.id)
 	}
 }
 
@@ -306,39 +453,188 @@ func (p *PlayerGameOver) HandleHubMessage(hm HubMessage, channelOpen bool, playe
 
 func (p *PlayerGameOver) Exit() {}
 
+// PlayerInQueue is waiting in the matchmaking queue or answering a ready check.
+// It leaves once the lobby the matchmaker asked for takes it in.
+type PlayerInQueue struct{}
+
+func (p *PlayerInQueue) Enter(player *Player) {}
+
+func (p *PlayerInQueue) HandleClientMessage(cm ClientMessage, channelOpen bool, player *Player) {
+	if !channelOpen {
+		// there is no seat to hold yet, so give up the place in the queue
+		player.SendToMatchmaker(PlayerDisconnected)
+		player.Disconnect()
+		return
+	}
+
+	switch cm.Type {
+	case ClientLeaveQueue:
+		player.SendToMatchmaker(PlayerLeaveQueue)
+		player.WriteToClient(newLeftQueueMessage(), player.id)
+		player.SetState(&PlayerInHub{})
+	case ClientReadyAccept:
+		player.SendToMatchmaker(PlayerReadyAccept)
+	case ClientReadyDecline:
+		player.SendToMatchmaker(PlayerReadyDecline)
+	}
+}
+
+// a matched lobby greets its players like a lobby that accepted a join.
+func (p *PlayerInQueue) HandleLobbyMessage(lm LobbyMessage, channelOpen bool, player *Player) {
+	if lm.msgType == LobbyAcceptPlayer {
+		player.WriteToClient(newRoomJoinedMessage(lm.lobbyCode, lm.token), player.id)
+		player.SetState(&PlayerInLobby{l: lm.lobby})
+	}
+}
+
+func (p *PlayerInQueue) HandleHubMessage(hm HubMessage, channelOpen bool, player *Player) {
+	switch hm.msgType {
+	case HubQueued:
+		player.WriteToClient(newQueuedMessage(), player.id)
+	case HubReadyCheck:
+		player.WriteToClient(newReadyCheckMessage(hm.players, hm.countdown), player.id)
+	case HubReadyCheckFailed:
+		player.WriteToClient(newReadyCheckFailedMessage(hm.reason, hm.requeued), player.id)
+		if !hm.requeued {
+			player.SetState(&PlayerInHub{})
+		}
+	case HubServerShuttingDown:
+		player.SendToMatchmaker(PlayerLeaveQueue)
+		player.SetState(&PlayerInHub{})
+	}
+}
+
+func (p *PlayerInQueue) Exit() {}
+
+// PlayerSpectating watches a lobby without a seat. It is sent everything the
+// players are sent, whatever the lobby is doing, and can only ask for a
+// snapshot or leave.
+type PlayerSpectating struct {
+	l *Lobby
+}
+
+func (p *PlayerSpectating) Enter(player *Player) {
+	player.lobby = p.l
+}
+
+func (p *PlayerSpectating) HandleClientMessage(cm ClientMessage, channelOpen bool, player *Player) {
+	if !channelOpen {
+		player.WaitForResume()
+		return
+	}
+
+	switch cm.Type {
+	case ClientLeaveRoom:
+		msg := PlayerMessage{
+			msgType:  PlayerLeaveRoom,
+			player:   player,
+			sender:   player.conn,
+			senderID: player.id,
+		}
+		player.SendToLobby(msg)
+		player.SetState(&PlayerInHub{})
+	case ClientRequestResync:
+		player.RequestSnapshot()
+	default:
+		player.Log().Debug("ignoring a message a spectator can't send", "type", cm.Type)
+	}
+}
+
+func (p *PlayerSpectating) HandleLobbyMessage(lm LobbyMessage, channelOpen bool, player *Player) {
+	switch lm.msgType {
+	case LobbySendGameStart:
+		otherPlayers := make([]PlayerIdentity, 0)
+		for i := range lm.allPlayers {
+			if lm.allPlayers[i].id != lm.player.id {
+				otherPlayers = append(otherPlayers, lm.allPlayers[i])
+			}
+		}
+		player.WriteToClient(newGameStartMessage(lm.currentMap, lm.nextMap, lm.player, otherPlayers, lm.seed), player.id)
+	case LobbySendEntityUpdate:
+		player.WriteToClient(newEntityUpdateMessage(lm.player, lm.allPlayers, lm.walls), player.id)
+	case LobbySendWallUpdate:
+		player.WriteToClient(newWallUpdateMessage(lm.walls), player.id)
+	case LobbySendMapUpdate:
+		player.WriteToClient(newMapUpdateMessage(lm.currentMap, lm.nextMap), player.id)
+	case LobbySendTurnTimeout:
+		player.WriteToClient(newTurnTimeoutMessage(lm.player.id), player.id)
+	case LobbySendTrajectory:
+		player.WriteToClient(newShotTrajectoryMessage(lm.trajectory), player.id)
+	case LobbyBroadcastMove:
+		player.WriteToClient(newBroadcastTurnMessage(lm.player, lm.action), player.id)
+	case LobbySendEliminations:
+		player.WriteToClient(newEliminationMessage(lm.eliminatedPlayers, lm.turnNumber), player.id)
+	case LobbySendGameOver:
+		player.WriteToClient(newGameFinishedMessage(lm.result, lm.winnerName, lm.kills, lm.standings), player.id)
+	case LobbySendPlayerToLobby:
+		player.WriteToClient(newReturnToLobbyMessage(), player.id)
+	case LobbyClose:
+		player.WriteToClient(newLobbyClosedMessage(), player.id)
+		player.SetState(&PlayerInHub{})
+	case LobbySendSnapshot:
+		player.WriteToClient(newStateSnapshotMessage(lm.lobbyCode, lm.inGame, lm.currentMap, lm.nextMap, lm.allPlayers, lm.walls, lm.player.id, lm.turnOrder, lm.eliminatedPlayers, lm.turnNumber), player.id)
+	}
+}
+
+func (p *PlayerSpectating) HandleHubMessage(hm HubMessage, channelOpen bool, player *Player) {}
+
+func (p *PlayerSpectating) Exit() {}
+
 type Player struct {
 	id           string
 	username     string
-	turnsPlayed  int
+	account      string // id of the account the player logged in to, "" if they didn't
 	conn         *websocket.Conn
+	outbound     chan ServerMessage // drained by WritePump for the current conn
 	socketClosed bool
 	state        PlayerState
 	clientMsg    chan ClientMessage
+	readerDone   chan struct{}     // closed to stop the reader of the current conn
 	readLobby    chan LobbyMessage //lobby will write into this
+	lagging      chan struct{}     //lobby signals here when readLobby overflowed
 	readHub      chan HubMessage
 	lobby        *Lobby
 	hub          *Hub
+	done         bool
+	graceTimer   *time.Timer
+	latency      atomic.Int64 // last ping round trip in nanoseconds, written by the reader
+	log          *slog.Logger // carries the player attribute, see Log
 }
 
 func (p *Player) SetState(newState PlayerState) {
 	if p.state != nil {
 		p.state.Exit()
 	}
-	fmt.Printf("[STATE] Entering %T for player %s\n", newState, p.id)
+	p.hub.metrics.PlayerStateChanged(p.state, newState)
 	p.state = newState
 	p.state.Enter(p)
+	p.Log().Debug("player changed state")
+}
+
+// Log returns the player's logger with the lobby and state it is in right now.
+// Only the player goroutine may call it, the pumps get a copy when they start.
+func (p *Player) Log() *slog.Logger {
+	code := ""
+	if p.lobby != nil {
+		code = p.lobby.code
+	}
+	return p.log.With("lobby", code, "state", stateName(p.state))
 }
 
 func GetNewPlayer(conn *websocket.Conn, hub *Hub) *Player {
+	id := randomAlphanumericString()
 	player := &Player{
-		id:           randomAlphanumericString(),
-		turnsPlayed:  0,
+		id:           id,
 		conn:         conn,
+		outbound:     make(chan ServerMessage, OUTBOUND_QUEUE_SIZE),
 		socketClosed: false,
-		clientMsg:    make(chan ClientMessage),
-		readLobby:    make(chan LobbyMessage),
-		readHub:      make(chan HubMessage),
+		clientMsg:    make(chan ClientMessage, 1), // room for the first message ServeWs already read
+		readerDone:   make(chan struct{}),
+		readLobby:    make(chan LobbyMessage, LOBBY_QUEUE_SIZE),
+		lagging:      make(chan struct{}, 1),
+		readHub:      make(chan HubMessage, HUB_QUEUE_SIZE),
 		hub:          hub,
+		log:          hub.log.With("player", id),
 	}
 	player.SetState(&PlayerInHub{})
 
@@ -346,32 +642,71 @@ func GetNewPlayer(conn *websocket.Conn, hub *Hub) *Player {
 }
 
 func (p *Player) Run() {
-	go p.ReadClientMessage()
-	defer fmt.Println("player goroutine exited")
+	go p.ReadClientMessage(p.conn, p.clientMsg, p.readerDone, p.Log())
+	go p.WritePump(p.conn, p.outbound, p.Log())
+	refresh := time.NewTicker(SESSION_REFRESH_IN_SECONDS * time.Second)
+	defer func() { p.Log().Debug("player goroutine exited") }()
+	defer refresh.Stop()
+	defer close(p.outbound)
+	defer func() { close(p.readerDone) }()
+	defer func() { p.hub.metrics.PlayerStateChanged(p.state, nil) }()
 
-	for {
+	for !p.done {
 		select {
 		case cm, ok := <-p.clientMsg:
+			if !ok {
+				// a closed channel is always ready, stop selecting on it
+				p.clientMsg = nil
+				p.socketClosed = true
+			}
 			p.HandleClientMessage(cm, ok)
 		case rm, ok := <-p.readLobby:
 			p.HandleLobbyMessage(rm, ok)
 		case hm, ok := <-p.readHub:
 			p.HandleHubMessage(hm, ok)
+		case <-p.lagging:
+			p.DropConnection()
+		case <-refresh.C:
+			p.RefreshSession()
+		case <-p.graceChannel():
+			p.graceTimer = nil
+			p.Log().Info("reconnect grace window ran out")
+			p.Disconnect()
 		}
 	}
 }
 
-func (p *Player) ReadClientMessage() {
+// ReadClientMessage pumps messages from one socket into out until done is
+// closed. It takes them as arguments because a resumed player swaps in a new
+// socket and channel while the reader of the old socket may still be winding
+// down, with nobody left to receive from out.
+func (p *Player) ReadClientMessage(conn *websocket.Conn, out chan ClientMessage, done chan struct{}, log *slog.Logger) {
 	defer func() {
-		p.conn.Close()
-		close(p.clientMsg)
+		conn.Close()
+		p.hub.metrics.ConnectionClosed()
+		close(out)
 	}()
 
+	// a peer that stops answering pings hits the read deadline, which ends
+	// this loop like any other read error.
+	pongWait := p.hub.config.PongWait()
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(appData string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		if len(appData) == 8 {
+			sent := int64(binary.BigEndian.Uint64([]byte(appData)))
+			p.latency.Store(time.Now().UnixNano() - sent)
+		}
+		return nil
+	})
+
 	for {
-		wsMsgType, data, err := p.conn.ReadMessage()
+		wsMsgType, data, err := conn.ReadMessage()
 		if err != nil {
+			log.Debug("read from client failed", "err", err)
 			return
 		}
+		conn.SetReadDeadline(time.Now().Add(pongWait))
 		if wsMsgType != websocket.TextMessage {
 			return
 		}
@@ -382,22 +717,329 @@ func (p *Player) ReadClientMessage() {
 			return
 		}
 
-		p.clientMsg <- msg
+		select {
+		case out <- msg:
+		case <-done:
+			return
+		}
 	}
 }
 
+// WritePump is the only goroutine that writes to conn. It sends whatever is
+// queued on out until out is closed or a write fails, then closes conn so the
+// reader notices and the normal disconnect path runs.
+// It also pings the client often enough that a live peer always answers
+// before the reader's deadline runs out.
+func (p *Player) WritePump(conn *websocket.Conn, out chan ServerMessage, log *slog.Logger) {
+	ticker := time.NewTicker(p.hub.config.PongWait() * 9 / 10)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-out:
+			if !ok {
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(p.hub.config.WriteWait()))
+			err := conn.WriteJSON(msg)
+			if err != nil {
+				log.Warn("write to client failed", "err", err)
+				p.hub.metrics.WriteFailed("write_error")
+				return
+			}
+		case <-ticker.C:
+			// the send time rides along in the ping so the pong tells us the round trip
+			payload := make([]byte, 8)
+			binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+			err := conn.WriteControl(websocket.PingMessage, payload, time.Now().Add(p.hub.config.WriteWait()))
+			if err != nil {
+				log.Warn("ping to client failed", "err", err)
+				return
+			}
+		}
+	}
+}
+
+// Latency is the round trip time of the last answered ping, zero until one is.
+func (p *Player) Latency() time.Duration {
+	return time.Duration(p.latency.Load())
+}
+
+// WriteToClient queues msg for the write pump. It never blocks: if the queue is
+// full the client is too slow to keep up and its connection is dropped.
 func (p *Player) WriteToClient(msg ServerMessage, playerID string) error {
 	if p.socketClosed {
+		p.hub.metrics.WriteFailed("closed")
 		return errors.New("connection closed, player ID: " + playerID)
 	}
 
-	err := p.conn.WriteJSON(msg)
+	select {
+	case p.outbound <- msg:
+		return nil
+	default:
+		p.hub.metrics.WriteFailed("queue_full")
+		p.DropConnection()
+		return errors.New("outbound queue full, player ID: " + playerID)
+	}
+}
+
+// QueueHubMessage hands the player a message from the matchmaker, or from the
+// hub on the matchmaker's behalf, without blocking the sender, which the
+// player may be waiting on at the same moment. As with the lobby queue, a
+// player whose queue is full has stopped keeping up, so the message is
+// dropped and the player is told to cut its connection; disconnecting takes
+// it out of the match queue. It is safe to call from any goroutine.
+func (p *Player) QueueHubMessage(hm HubMessage) {
+	select {
+	case p.readHub <- hm:
+	default:
+		p.log.Warn("hub queue full, dropping player connection", "hub_message", hm.msgType)
+		select {
+		case p.lagging <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// DropConnection closes the socket; the reader then closes clientMsg and the
+// player goes through the usual disconnect (or resume) path.
+func (p *Player) DropConnection() {
+	if p.socketClosed {
+		return
+	}
+	p.Log().Warn("dropping connection")
+	p.socketClosed = true
+	p.conn.Close()
+}
+
+// Disconnect tells the player's lobby, if any, that the socket is gone and
+// ends the Run loop. Lobby messages that arrive while we wait are dropped so a
+// lobby blocked on writing to us can still take our message.
+func (p *Player) Disconnect() {
+	if p.lobby != nil {
+		msg := PlayerMessage{
+			msgType:  PlayerDisconnected,
+			player:   p,
+			sender:   p.conn,
+			senderID: p.id,
+		}
+		for sent := false; !sent; {
+			select {
+			case p.lobby.Inbound <- msg:
+				sent = true
+			case <-p.lobby.done:
+				sent = true
+			case <-p.readLobby:
+			}
+		}
+	}
+
+	// the hub may be handing us a resumed socket right now, turn it away
+	msg := PlayerMessage{
+		msgType:  PlayerEndSession,
+		player:   p,
+		senderID: p.id,
+	}
+	for sent := false; !sent; {
+		select {
+		case p.hub.readPlayer <- msg:
+			sent = true
+		case hm := <-p.readHub:
+			p.RejectResume(hm)
+		}
+	}
+	// anything the hub queued before it took our message is still buffered,
+	// including a seat in a matched lobby it opened before it heard we left
+	for drained := false; !drained; {
+		select {
+		case hm := <-p.readHub:
+			p.RejectResume(hm)
+		case lm := <-p.readLobby:
+			p.TurnDownSeat(lm)
+		default:
+			drained = true
+		}
+	}
+	p.done = true
+}
+
+// TurnDownSeat hands back a seat lm gives the player when it no longer wants
+// one. The matched lobby that offers it has already started its game, so the
+// seat is forfeited like a dropped player's.
+func (p *Player) TurnDownSeat(lm LobbyMessage) {
+	if lm.msgType != LobbyAcceptPlayer {
+		return
+	}
+	p.Log().Info("turning down a seat the player no longer wants", "seat_lobby", lm.lobbyCode)
+	msg := PlayerMessage{
+		msgType:  PlayerDisconnected,
+		player:   p,
+		sender:   p.conn,
+		senderID: p.id,
+	}
+	select {
+	case lm.lobby.Inbound <- msg:
+	case <-lm.lobby.done:
+	}
+}
+
+func (p *Player) RejectResume(hm HubMessage) {
+	if hm.msgType == HubResumeSession {
+		hm.conn.WriteJSON(newResumeFailedMessage())
+		hm.conn.Close()
+		p.hub.metrics.ConnectionClosed()
+	}
+}
+
+// SendToLobby hands msg to the player's lobby, dropping it if the lobby has
+// already closed so the player never blocks on a lobby that is gone.
+func (p *Player) SendToLobby(msg PlayerMessage) {
+	select {
+	case p.lobby.Inbound <- msg:
+	case <-p.lobby.done:
+	}
+}
+
+// SetUsername sets the name the player shows up as. A logged in player always
+// plays under their account's name.
+func (p *Player) SetUsername(username string) {
+	if p.account != "" {
+		return
+	}
+	p.username = username
+}
+
+// LogIn answers register, login and guest-login. The store is slow on purpose
+// for passwords, so this holds up only this player.
+func (p *Player) LogIn(cm ClientMessage) {
+	var profile Profile
+	var guestToken string
+	var err error
+	switch {
+	case cm.Type == ClientRegister:
+		profile, err = p.hub.store.Register(cm.Username, cm.Password)
+	case cm.Type == ClientLogin:
+		profile, err = p.hub.store.Login(cm.Username, cm.Password)
+	case cm.Token != "":
+		profile, err = p.hub.store.GuestLogin(cm.Token)
+	default:
+		profile, guestToken, err = p.hub.store.CreateGuest(cm.Username)
+	}
+	if err != nil {
+		reason := err.Error()
+		switch err {
+		case ErrUsernameTaken, ErrInvalidUsername, ErrWeakPassword, ErrBadCredentials:
+		default:
+			p.Log().Error("store failed to log a player in", "err", err)
+			reason = "store-error"
+		}
+		p.WriteToClient(newLoginFailedMessage(reason), p.id)
+		return
+	}
+	p.account = profile.ID
+	p.username = profile.Username
+	p.Log().Info("player logged in", "account", profile.ID, "guest", profile.Guest)
+	p.WriteToClient(newLoggedInMessage(profile, guestToken), p.id)
+}
+
+// Rating is the logged in player's stored rating. Anyone else, or anyone the
+// store can't answer for, is matched as a new player.
+func (p *Player) Rating() float64 {
+	if p.account == "" {
+		return DEFAULT_RATING
+	}
+	profile, err := p.hub.store.Profile(p.account)
 	if err != nil {
-		p.socketClosed = true
+		p.Log().Error("store failed to look up a rating", "err", err)
+		return DEFAULT_RATING
+	}
+	return profile.Rating
+}
+
+// SendToMatchmaker tells the matchmaker something about this player.
+func (p *Player) SendToMatchmaker(msgType PlayerMessageType) {
+	p.hub.matchmaker.readPlayer <- PlayerMessage{
+		msgType:  msgType,
+		player:   p,
+		sender:   p.conn,
+		senderID: p.id,
+	}
+}
+
+// WaitForResume keeps the player's seat for a grace window after its socket
+// closes. If no resume arrives in time the player is disconnected for good.
+func (p *Player) WaitForResume() {
+	p.Log().Info("player lost their connection, holding their seat")
+	p.StopGraceTimer()
+	p.graceTimer = time.NewTimer(RECONNECT_GRACE_IN_SECONDS * time.Second)
+}
+
+func (p *Player) StopGraceTimer() {
+	if p.graceTimer != nil {
+		p.graceTimer.Stop()
+		p.graceTimer = nil
+	}
+}
+
+func (p *Player) graceChannel() <-chan time.Time {
+	if p.graceTimer == nil {
+		return nil
+	}
+	return p.graceTimer.C
+}
+
+// Resume rebinds a reconnecting client's socket to this player and asks the
+// lobby for a snapshot so the client can pick up where it left off.
+func (p *Player) Resume(conn *websocket.Conn) {
+	p.Log().Info("player resumed their session")
+	if !p.socketClosed {
 		p.conn.Close()
-		return err
 	}
-	return nil
+	p.StopGraceTimer()
+	p.conn = conn
+	p.socketClosed = false
+	p.clientMsg = make(chan ClientMessage)
+	close(p.readerDone)
+	p.readerDone = make(chan struct{})
+	close(p.outbound)
+	p.outbound = make(chan ServerMessage, OUTBOUND_QUEUE_SIZE)
+	go p.ReadClientMessage(p.conn, p.clientMsg, p.readerDone, p.Log())
+	go p.WritePump(p.conn, p.outbound, p.Log())
+
+	code := ""
+	if p.lobby != nil {
+		code = p.lobby.code
+	}
+	p.WriteToClient(newSessionResumedMessage(p.id, code), p.id)
+	p.RefreshSession()
+
+	if p.lobby != nil {
+		p.RequestSnapshot()
+	}
+}
+
+// RefreshSession sends a player in a lobby a fresh session token, so the one
+// they resume with is never much older than the connection drop.
+func (p *Player) RefreshSession() {
+	if p.lobby == nil || p.socketClosed {
+		return
+	}
+	p.WriteToClient(newSessionTokenMessage(p.hub.IssueSessionToken(p, p.lobby.code)), p.id)
+}
+
+// RequestSnapshot asks the lobby for everything the client needs to redraw,
+// for a client that has just resumed or thinks it has drifted.
+func (p *Player) RequestSnapshot() {
+	msg := PlayerMessage{
+		msgType:  PlayerRequestSnapshot,
+		player:   p,
+		sender:   p.conn,
+		senderID: p.id,
+	}
+	p.SendToLobby(msg)
 }
 
 func (p *Player) HandleClientMessage(cm ClientMessage, channelOpen bool) {
@@ -409,6 +1051,20 @@ func (p *Player) HandleLobbyMessage(lm LobbyMessage, channelOpen bool) {
 }
 
 func (p *Player) HandleHubMessage(hm HubMessage, channelOpen bool) {
+	// a resumed session can land in any state, so it is handled here.
+	if hm.msgType == HubResumeSession {
+		// the token is only good for the lobby the seat is in now
+		if p.lobby == nil || p.lobby.code != hm.code {
+			p.Log().Info("rejected a resume for another lobby", "token_lobby", hm.code)
+			p.RejectResume(hm)
+			return
+		}
+		p.Resume(hm.conn)
+		return
+	}
+	if hm.msgType == HubServerShuttingDown {
+		p.WriteToClient(newServerShuttingDownMessage(hm.countdown), p.id)
+	}
 	p.state.HandleHubMessage(hm, channelOpen, p)
 }
 
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 20
+	MAX_PAGE_SIZE     = 100
+)
+
+// The read-only JSON API over the store, for sites and bots. Lists take
+// ?offset= and ?limit= and say how many items there are in all.
+
+type PageInfo struct {
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+	Total  int `json:"total"`
+}
+
+type LeaderboardEntry struct {
+	Rank int `json:"rank"`
+	Profile
+}
+
+type LeaderboardResponse struct {
+	By      string             `json:"by"`
+	Page    PageInfo           `json:"page"`
+	Entries []LeaderboardEntry `json:"entries"`
+}
+
+// PlayerMatch is one match from one player's side.
+type PlayerMatch struct {
+	ID           string    `json:"id"`
+	FinishedAt   time.Time `json:"finished_at"`
+	Result       string    `json:"result"`
+	Players      int       `json:"players"`
+	Placement    int       `json:"placement"`
+	Knockouts    int       `json:"knockouts"`
+	Turns        int       `json:"turns"`
+	RatingBefore float64   `json:"rating_before"`
+	RatingAfter  float64   `json:"rating_after"`
+}
+
+type PlayerMatchesResponse struct {
+	Player  Profile       `json:"player"`
+	Page    PageInfo      `json:"page"`
+	Matches []PlayerMatch `json:"matches"`
+}
+
+type MatchResponse struct {
+	MatchRecord
+	EliminationOrder []string `json:"elimination_order"` // player ids, first out first
+}
+
+// ServeLeaderboard answers GET /leaderboard?by=rating|wins.
+func (h *Hub) ServeLeaderboard(w http.ResponseWriter, r *http.Request) {
+	by := r.URL.Query().Get("by")
+	if by == "" {
+		by = "rating"
+	}
+	if by != "rating" && by != "wins" {
+		http.Error(w, "by must be rating or wins", http.StatusBadRequest)
+		return
+	}
+	offset, limit, ok := ParsePage(w, r)
+	if !ok {
+		return
+	}
+	profiles, total, err := h.store.Leaderboard(by, offset, limit)
+	if err != nil {
+		h.StoreError(w, err)
+		return
+	}
+	resp := LeaderboardResponse{By: by, Page: PageInfo{offset, limit, total}, Entries: make([]LeaderboardEntry, 0, len(profiles))}
+	for i, profile := range profiles {
+		resp.Entries = append(resp.Entries, LeaderboardEntry{Rank: offset + i + 1, Profile: profile})
+	}
+	WriteJSON(w, resp)
+}
+
+// ServePlayerMatches answers GET /players/{id}/matches.
+func (h *Hub) ServePlayerMatches(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	offset, limit, ok := ParsePage(w, r)
+	if !ok {
+		return
+	}
+	profile, err := h.store.Profile(id)
+	if err != nil {
+		h.StoreError(w, err)
+		return
+	}
+	matches, total, err := h.store.PlayerMatches(id, offset, limit)
+	if err != nil {
+		h.StoreError(w, err)
+		return
+	}
+	resp := PlayerMatchesResponse{Player: profile, Page: PageInfo{offset, limit, total}, Matches: make([]PlayerMatch, 0, len(matches))}
+	for _, match := range matches {
+		i := slices.IndexFunc(match.Players, func(p MatchPlayer) bool { return p.AccountID == id })
+		me := match.Players[i]
+		resp.Matches = append(resp.Matches, PlayerMatch{
+			ID:           match.ID,
+			FinishedAt:   match.FinishedAt,
+			Result:       match.Result,
+			Players:      len(match.Players),
+			Placement:    me.Placement,
+			Knockouts:    me.Knockouts,
+			Turns:        me.Turns,
+			RatingBefore: me.RatingBefore,
+			RatingAfter:  me.RatingAfter,
+		})
+	}
+	WriteJSON(w, resp)
+}
+
+// ServeMatch answers GET /matches/{id}.
+func (h *Hub) ServeMatch(w http.ResponseWriter, r *http.Request) {
+	match, err := h.store.Match(r.PathValue("id"))
+	if err != nil {
+		h.StoreError(w, err)
+		return
+	}
+	out := make([]MatchPlayer, 0, len(match.Players))
+	for _, p := range match.Players {
+		if p.EliminatedOn != 0 {
+			out = append(out, p)
+		}
+	}
+	slices.SortStableFunc(out, func(a, b MatchPlayer) int { return cmp.Compare(a.EliminatedOn, b.EliminatedOn) })
+	resp := MatchResponse{MatchRecord: match, EliminationOrder: make([]string, 0, len(out))}
+	for _, p := range out {
+		resp.EliminationOrder = append(resp.EliminationOrder, p.PlayerID)
+	}
+	WriteJSON(w, resp)
+}
+
+// ParsePage reads ?offset= and ?limit=, answering 400 itself if they are bad.
+func ParsePage(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	offset, limit := 0, DEFAULT_PAGE_SIZE
+	var err error
+	if s := r.URL.Query().Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			http.Error(w, "bad offset", http.StatusBadRequest)
+			return 0, 0, false
+		}
+	}
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > MAX_PAGE_SIZE {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(MAX_PAGE_SIZE), http.StatusBadRequest)
+			return 0, 0, false
+		}
+	}
+	return offset, limit, true
+}
+
+func (h *Hub) StoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	h.log.Error("store failed to answer an api request", "err", err)
+	http.Error(w, "store error", http.StatusInternalServerError)
+}
+
+func WriteJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const CONFIG_ENV_PREFIX = "KILLIARDS_"
+
+// Config is everything about the server binary that can be changed without a
+// rebuild. Values come from the defaults, then an optional JSON file, then
+// environment variables, then command-line flags, each overriding the last.
+type Config struct {
+	ListenAddr         string   `json:"listen_addr"`
+	TLSCertFile        string   `json:"tls_cert_file"`
+	TLSKeyFile         string   `json:"tls_key_file"`
+	AllowedOrigins     []string `json:"allowed_origins"` // "*" allows any origin
+	ReadBufferSize     int      `json:"read_buffer_size"`
+	WriteBufferSize    int      `json:"write_buffer_size"`
+	MaxMessageSize     int64    `json:"max_message_size"`
+	TurnTimerSeconds   int      `json:"turn_timer_seconds"`
+	MinLobbyPlayers    int      `json:"min_lobby_players"`
+	MaxLobbyPlayers    int      `json:"max_lobby_players"`
+	MaxSpectators      int      `json:"max_spectators"`       // per lobby, on top of the players
+	RatingWindow       float64  `json:"rating_window"`        // rating gap the matchmaker accepts at first
+	RatingWindowGrowth float64  `json:"rating_window_growth"` // how much the gap widens per second of waiting
+	MatchFillSeconds   int      `json:"match_fill_seconds"`   // how long a match waits to fill before starting smaller
+	PongWaitSeconds    int      `json:"pong_wait_seconds"`
+	WriteWaitSeconds   int      `json:"write_wait_seconds"`
+	ShutdownSeconds    int      `json:"shutdown_seconds"` // countdown given to players before the server exits
+	LogFormat          string   `json:"log_format"`       // "text" or "json"
+	LogLevel           string   `json:"log_level"`        // debug, info, warn or error
+	TrajectoryEvery    int      `json:"trajectory_every"` // physics steps between shot-trajectory frames, 0 sends none
+	ReplayDir          string   `json:"replay_dir"`       // where finished matches are saved, "" saves none
+	StoreFile          string   `json:"store_file"`       // accounts, ratings and match results, "" keeps them in memory
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:         "localhost:8000",
+		AllowedOrigins:     []string{"*"},
+		ReadBufferSize:     1024,
+		WriteBufferSize:    1024,
+		MaxMessageSize:     4096,
+		TurnTimerSeconds:   TURN_TIMER_IN_SECONDS,
+		MinLobbyPlayers:    2,
+		MaxLobbyPlayers:    8,
+		MaxSpectators:      16,
+		RatingWindow:       100,
+		RatingWindowGrowth: 10,
+		MatchFillSeconds:   20,
+		PongWaitSeconds:    PONG_WAIT_IN_SECONDS,
+		WriteWaitSeconds:   WRITE_WAIT_IN_SECONDS,
+		ShutdownSeconds:    15,
+		LogFormat:          "text",
+		LogLevel:           "info",
+		ReplayDir:          "replays",
+		StoreFile:          "killiards-store.json",
+	}
+}
+
+// configSetting ties one Config field to its flag name. The environment
+// variable is the flag name upper-cased with dashes turned into underscores
+// and CONFIG_ENV_PREFIX in front, e.g. --listen-addr and KILLIARDS_LISTEN_ADDR.
+type configSetting struct {
+	name  string
+	usage string
+	set   func(cfg *Config, value string) error
+}
+
+var configSettings = []configSetting{
+	{"listen-addr", "address to listen on", func(cfg *Config, v string) error {
+		cfg.ListenAddr = v
+		return nil
+	}},
+	{"tls-cert", "TLS certificate file, serves plain http when empty", func(cfg *Config, v string) error {
+		cfg.TLSCertFile = v
+		return nil
+	}},
+	{"tls-key", "TLS key file, serves plain http when empty", func(cfg *Config, v string) error {
+		cfg.TLSKeyFile = v
+		return nil
+	}},
+	{"allowed-origins", "comma separated origins allowed to open a websocket, * for any", func(cfg *Config, v string) error {
+		cfg.AllowedOrigins = splitList(v)
+		return nil
+	}},
+	{"read-buffer-size", "websocket read buffer size in bytes", func(cfg *Config, v string) error {
+		return parseInt(v, &cfg.ReadBufferSize)
+	}},
+	{"write-buffer-size", "websocket write buffer size in bytes", func(cfg *Config, v string) error {
+		return parseInt(v, &cfg.WriteBufferSize)
+	}},
+	{"max-message-size", "largest message a client may send, in bytes", func(cfg *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		cfg.MaxMessageSize = n
+		return err
+	}},
+	{"turn-timer", "default seconds a player has to take their turn", func(cfg *Config, v string) error {
+		return parseInt(v, &cfg.TurnTimerSeconds)
+	}},
+	{"min-lobby-players", "players needed before a game can start", func(cfg *Config, v string) error {
+		return parseInt(v, &cfg.MinLobbyPlayers)
+	}},
+	{"max-lobby-players", "most players a lobby will take", func(cfg *Config, v string) error {
+		return parseInt(v, &cfg.MaxLobbyPlayers)
+	}},
+	{"max-spectators", "most spectators a lobby will take, on top of its players", func(cfg *Config, v string) error {
+		return parseInt(v, &cfg.MaxSpectators)
+	}},
+	{"rating-window", "rating gap the matchmaker accepts between players at first", func(cfg *Config, v string) error {
+		return parseFloat(v, &cfg.RatingWindow)
+	}},
+	{"rating-window-growth", "rating points the matchmaker's window widens by per second of waiting", func(cfg *Config, v string) error {
+		return parseFloat(v, &cfg.RatingWindowGrowth)
+	}},
+	{"match-fill-wait", "seconds a match waits for a full lobby before starting with fewer players", func(cfg *Config, v string) error {
+		return parseInt(v, &cfg.MatchFillSeconds)
+	}},
+	{"pong-wait", "seconds a connection may go without answering a ping", func(cfg *Config, v string) error {
+		return parseInt(v, &cfg.PongWaitSeconds)
+	}},
+	{"write-wait", "seconds allowed for a single write to a connection", func(cfg *Config, v string) error {
+		return parseInt(v, &cfg.WriteWaitSeconds)
+	}},
+	{"shutdown-timeout", "seconds lobbies get to wrap up after SIGINT/SIGTERM", func(cfg *Config, v string) error {
+		return parseInt(v, &cfg.ShutdownSeconds)
+	}},
+	{"trajectory-every", "physics steps between shot-trajectory frames, 0 turns the message off", func(cfg *Config, v string) error {
+		return parseInt(v, &cfg.TrajectoryEvery)
+	}},
+	{"replay-dir", "directory finished matches are saved to as replays, empty to save none", func(cfg *Config, v string) error {
+		cfg.ReplayDir = v
+		return nil
+	}},
+	{"store-file", "file accounts, ratings and match results are kept in, empty to keep them in memory only", func(cfg *Config, v string) error {
+		cfg.StoreFile = v
+		return nil
+	}},
+	{"log-format", "log output format, text or json", func(cfg *Config, v string) error {
+		cfg.LogFormat = v
+		return nil
+	}},
+	{"log-level", "lowest level logged: debug, info, warn or error", func(cfg *Config, v string) error {
+		cfg.LogLevel = v
+		return nil
+	}},
+}
+
+// LoadConfig builds the effective config from args and the environment. The
+// second return value reports whether --print-config was given.
+func LoadConfig(args []string) (Config, bool, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("killiards", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(CONFIG_ENV_PREFIX+"CONFIG"), "optional JSON config file")
+	printConfig := fs.Bool("print-config", false, "print the effective config and exit")
+
+	// flags are applied last, so only remember them while parsing
+	flagValues := make([]func(cfg *Config) error, 0)
+	for _, s := range configSettings {
+		fs.Func(s.name, s.usage, func(v string) error {
+			flagValues = append(flagValues, func(cfg *Config) error { return s.set(cfg, v) })
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, false, err
+	}
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return cfg, false, err
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, false, fmt.Errorf("config file %s: %w", *configFile, err)
+		}
+	}
+
+	for _, s := range configSettings {
+		env := CONFIG_ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+		if v, ok := os.LookupEnv(env); ok {
+			if err := s.set(&cfg, v); err != nil {
+				return cfg, false, fmt.Errorf("%s: %w", env, err)
+			}
+		}
+	}
+
+	for _, apply := range flagValues {
+		if err := apply(&cfg); err != nil {
+			return cfg, false, err
+		}
+	}
+
+	return cfg, *printConfig, cfg.Validate()
+}
+
+func (c Config) Validate() error {
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("tls-cert and tls-key must be set together")
+	}
+	if c.MinLobbyPlayers < 1 || c.MaxLobbyPlayers < c.MinLobbyPlayers {
+		return errors.New("lobby size limits need 1 <= min-lobby-players <= max-lobby-players")
+	}
+	if c.MaxSpectators < 0 {
+		return errors.New("max-spectators can't be negative")
+	}
+	if c.RatingWindow < 0 || c.RatingWindowGrowth < 0 || c.MatchFillSeconds < 0 {
+		return errors.New("rating-window, rating-window-growth and match-fill-wait can't be negative")
+	}
+	if c.MaxMessageSize <= 0 || c.ReadBufferSize <= 0 || c.WriteBufferSize <= 0 {
+		return errors.New("message and buffer sizes must be positive")
+	}
+	if c.PongWaitSeconds <= 0 || c.WriteWaitSeconds <= 0 || c.ShutdownSeconds <= 0 {
+		return errors.New("pong-wait, write-wait and shutdown-timeout must be positive")
+	}
+	if c.TrajectoryEvery < 0 {
+		return errors.New("trajectory-every can't be negative")
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return errors.New("log-format must be text or json")
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("log-level: %w", err)
+	}
+	return nil
+}
+
+func (c Config) UseTLS() bool {
+	return c.TLSCertFile != ""
+}
+
+// CheckOrigin reports whether a websocket upgrade from r is allowed. Requests
+// without an Origin header don't come from a browser and are let through.
+func (c Config) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Config) PongWait() time.Duration {
+	return time.Duration(c.PongWaitSeconds) * time.Second
+}
+
+func (c Config) WriteWait() time.Duration {
+	return time.Duration(c.WriteWaitSeconds) * time.Second
+}
+
+func (c Config) ShutdownTimeout() time.Duration {
+	return time.Duration(c.ShutdownSeconds) * time.Second
+}
+
+// LogLevelValue is LogLevel as a slog level. Validate has already rejected
+// anything it can't parse, so a bad value just falls back to info.
+func (c Config) LogLevelValue() slog.Level {
+	level, err := parseLogLevel(c.LogLevel)
+	if err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+func splitList(v string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseFloat(v string, dst *float64) error {
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return err
+	}
+	*dst = n
+	return nil
+}
+
+func parseInt(v string, dst *int) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*dst = n
+	return nil
+}
@@ -1,39 +1,84 @@
 package main
 
 import (
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/Tacoman44444/killiardsgame/server/tools"
 )
 
 const (
-	TURN_TIMER_IN_SECONDS                = 3
+	TURN_TIMER_IN_SECONDS                = 30
+	MIN_TURN_TIMER_IN_SECONDS            = 5
+	MAX_TURN_TIMER_IN_SECONDS            = 120
 	CLIENT_AFFIRMATON_TIMEOUT_IN_SECONDS = 10
+	SIMULATION_GRACE_IN_MILLISECONDS     = 1500
+	CLIENT_PHYSICS_STEPS_PER_SECOND      = 60 // clients advance one physics step per animation frame
 	PUCK_RADIUS                          = 16.0
+	WALL_SIZE                            = 64.0 // walls are square, the client draws them this big
+	WALL_LIFETIME_IN_TURNS               = 6
+	WALLS_PER_PLAYER                     = 3 // walls each player may place in one game
 )
 
+// SHOT_POWER_LEVELS are the speeds the client's five power levels map to, in
+// world units per second. A shot has to use one of them.
+var SHOT_POWER_LEVELS = []int{200, 500, 900, 1200, 1500}
+
 type PlayerIdentity struct {
-	id       string
-	circle   *tools.Circle
-	username string
+	id            string
+	circle        *tools.Circle
+	username      string
+	alive         bool
+	turnsPlayed   int
+	slot          int     // fixed for the whole game, clients pick the puck colour from it
+	lastTouchedBy string  // id of the last player whose puck hit this one
+	killedBy      string  // who got the credit for knocking this one out
+	eliminatedOn  int     // turn this puck was knocked out on, 0 while it is still in
+	shots         int     // shots this player took
+	distance      float64 // how far this puck travelled, in world units
+}
+
+// Standing is one player's place in a finished match.
+type Standing struct {
+	Placement    int     `json:"placement"` // players knocked out on the same turn share one
+	Id           string  `json:"id"`
+	Username     string  `json:"username"`
+	EliminatedOn int     `json:"eliminated_on"` // the turn, 0 if they were never knocked out
+	Knockouts    int     `json:"knockouts"`
+	Shots        int     `json:"shots"`
+	Distance     float64 `json:"distance"` // world units their puck travelled
 }
 
 type ClientPlayerIdentity struct {
-	Id        string  `json:"id"`
-	PositionX float64 `json:"position_x"`
-	PositionY float64 `json:"position_y"`
-	VelocityX float64 `json:"velocity_x"`
-	VelocityY float64 `json:"velocity_y"`
-	Username  string  `json:"username"`
+	Id            string  `json:"id"`
+	PositionX     float64 `json:"position_x"`
+	PositionY     float64 `json:"position_y"`
+	VelocityX     float64 `json:"velocity_x"`
+	VelocityY     float64 `json:"velocity_y"`
+	Username      string  `json:"username"`
+	Alive         bool    `json:"alive"`
+	TurnsPlayed   int     `json:"turns_played"`
+	Slot          int     `json:"slot"`
+	LastTouchedBy string  `json:"last_touched_by,omitempty"`
+	KilledBy      string  `json:"killed_by,omitempty"`
 }
 
 func FormatPlayerId(playerId PlayerIdentity) ClientPlayerIdentity {
 	return ClientPlayerIdentity{
-		Id:        playerId.id,
-		PositionX: playerId.circle.Center.X,
-		PositionY: playerId.circle.Center.Y,
-		VelocityX: playerId.circle.Velocity.X,
-		VelocityY: playerId.circle.Velocity.Y,
+		Id:            playerId.id,
+		PositionX:     playerId.circle.Center.X,
+		PositionY:     playerId.circle.Center.Y,
+		VelocityX:     playerId.circle.Velocity.X,
+		VelocityY:     playerId.circle.Velocity.Y,
+		Username:      playerId.username,
+		Alive:         playerId.alive,
+		TurnsPlayed:   playerId.turnsPlayed,
+		Slot:          playerId.slot,
+		LastTouchedBy: playerId.lastTouchedBy,
+		KilledBy:      playerId.killedBy,
 	}
 }
 
@@ -58,9 +103,51 @@ func PlayerActionToShotData(action PlayerAction) tools.ShotData {
 	}
 }
 
+// ValidatePlayerAction checks a shot before it goes anywhere near the physics.
+// It returns the reason the shot was turned down, or "" if it is fine.
+func ValidatePlayerAction(action PlayerAction) string {
+	if !slices.Contains(SHOT_POWER_LEVELS, action.Power) {
+		return "power-out-of-range"
+	}
+	x, y := action.DirectionHorizontal, action.DirectionVertical
+	if math.IsNaN(x) || math.IsNaN(y) || math.IsInf(x, 0) || math.IsInf(y, 0) {
+		return "direction-not-finite"
+	}
+	// a direction so long its squared length overflows can't be normalized either
+	length := tools.Vector2{X: x, Y: y}.Length()
+	if length == 0 {
+		return "direction-zero"
+	}
+	if math.IsInf(length, 0) {
+		return "direction-not-finite"
+	}
+	return ""
+}
+
+// WallState is a wall on the board. Clients only send the position, the server
+// fills in the rest when it accepts the wall.
 type WallState struct {
-	rect      *tools.Rect
-	turnsLeft int
+	PositionX float64 `json:"position_x"` // top left corner
+	PositionY float64 `json:"position_y"`
+	Width     float64 `json:"width"`
+	Height    float64 `json:"height"`
+	TurnsLeft int     `json:"turns_left"`
+	Owner     string  `json:"owner"`
+}
+
+func NewWallState(positionX, positionY float64, owner string) *WallState {
+	return &WallState{
+		PositionX: positionX,
+		PositionY: positionY,
+		Width:     WALL_SIZE,
+		Height:    WALL_SIZE,
+		TurnsLeft: WALL_LIFETIME_IN_TURNS,
+		Owner:     owner,
+	}
+}
+
+func (w *WallState) Rect() tools.Rect {
+	return tools.Rect{TopLeft: tools.Vector2{X: w.PositionX, Y: w.PositionY}, Width: w.Width, Height: w.Height}
 }
 
 func WallStateRefToWallState(wallState []*WallState) []WallState {
@@ -77,53 +164,241 @@ func WallStateRefToWallState(wallState []*WallState) []WallState {
 }
 
 type GameState struct {
-	players   map[string]*PlayerIdentity
-	mapState  *tools.MapState
-	nextMap   *tools.MapState
-	walls     []*WallState
-	turnTimer time.Duration
+	players     map[string]*PlayerIdentity
+	mapState    *tools.MapState
+	nextMap     *tools.MapState
+	walls       []*WallState
+	wallsPlaced map[string]int // player id -> walls placed this game
+	kills       map[string]int // player id -> pucks they knocked out this game
+	lastShot    ShotRecord
+	turnTimer   time.Duration
+	seed        string
+	rng         *rand.Rand // the match's only random source, seeded from seed
+}
+
+// ShotTrajectory is where every puck was during a shot, sampled every
+// stepInterval physics steps. ids[i] is the puck at frames[n][i].
+type ShotTrajectory struct {
+	shooter      string
+	ids          []string
+	stepInterval int
+	frames       [][]tools.Vector2
+}
+
+func NewShotTrajectory(shooter string, players []*PlayerIdentity, stepInterval int, result tools.ShotResult) ShotTrajectory {
+	ids := make([]string, 0, len(players))
+	for _, player := range players {
+		ids = append(ids, player.id)
+	}
+	return ShotTrajectory{shooter: shooter, ids: ids, stepInterval: stepInterval, frames: result.Frames}
+}
+
+// ShotRecord is who took the last shot and whose pucks it hit.
+type ShotRecord struct {
+	shooter string
+	touched map[string]bool
+}
+
+// PlaceWall checks a wall the player wants to put down and adds it to the
+// board. It returns the reason the wall was turned down, or "" if it was placed.
+func (g *GameState) PlaceWall(wall *WallState) string {
+	if g.wallsPlaced[wall.Owner] >= WALLS_PER_PLAYER {
+		return "no-walls-left"
+	}
+	for _, v := range []float64{wall.PositionX, wall.PositionY} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "outside-arena"
+		}
+	}
+	rect := wall.Rect()
+	if !tools.IsRectOnArena(g.mapState, rect) {
+		return "outside-arena"
+	}
+	for _, player := range g.players {
+		if rect.OverlapsCircle(*player.circle) {
+			return "overlaps-puck"
+		}
+	}
+	for _, other := range g.walls {
+		if rect.Overlaps(other.Rect()) {
+			return "overlaps-wall"
+		}
+	}
+	g.walls = append(g.walls, wall)
+	g.wallsPlaced[wall.Owner]++
+	return ""
+}
+
+// RecordShot remembers who shot and, for every puck that got hit, whose puck
+// hit it last. players must be in the order the circles were given to
+// PhysicsResolver.
+func (g *GameState) RecordShot(shooter string, players []*PlayerIdentity, result tools.ShotResult) {
+	g.lastShot = ShotRecord{shooter: shooter, touched: make(map[string]bool)}
+	g.players[shooter].shots++
+	for i, distance := range result.Distances {
+		players[i].distance += distance
+	}
+	for _, contact := range result.Contacts {
+		a, b := players[contact.A], players[contact.B]
+		a.lastTouchedBy = b.id
+		b.lastTouchedBy = a.id
+		g.lastShot.touched[a.id] = true
+		g.lastShot.touched[b.id] = true
+	}
+}
+
+// CreditKill works out who knocked victim out and counts it for them. A puck
+// hit during the last shot goes to the shooter; the shooter's own puck, or one
+// that fell some other way (like the arena shrinking), goes to the last puck
+// that hit it. It returns the killer's id, "" when nobody gets the credit.
+func (g *GameState) CreditKill(victim *PlayerIdentity) string {
+	killer := victim.lastTouchedBy
+	if g.lastShot.touched[victim.id] && victim.id != g.lastShot.shooter {
+		killer = g.lastShot.shooter
+	}
+	victim.killedBy = killer
+	if killer != "" {
+		g.kills[killer]++
+	}
+	return killer
 }
 
-func GetNewGame(playerIDs []string, playerUsernames []string) *GameState {
+// TickWalls takes a turn off every wall's lifetime and removes the ones that
+// have run out. It reports whether any wall was removed.
+func (g *GameState) TickWalls() bool {
+	kept := make([]*WallState, 0, len(g.walls))
+	for _, wall := range g.walls {
+		wall.TurnsLeft--
+		if wall.TurnsLeft > 0 {
+			kept = append(kept, wall)
+		}
+	}
+	expired := len(kept) != len(g.walls)
+	g.walls = kept
+	return expired
+}
 
-	mapState := tools.GenerateMap(200, 200, false, "")
-	nextMap := tools.ShrinkArena(mapState)
+// GetNewGame sets up a match. playerIDs should be in seat order: with the same
+// seed and the same order the board and spawns come out the same every time.
+func GetNewGame(playerIDs []string, playerUsernames []string, turnTimer time.Duration, seed string) *GameState {
+	rng := tools.NewSeededRand(seed)
+	mapState := tools.GenerateMap(200, 200, rng)
+	nextMap := tools.ShrinkArena(mapState, rng)
 	playerMap := make(map[string]*PlayerIdentity, len(playerIDs))
-	safeSpawns := tools.GenerateSafeSpawns(len(playerIDs), mapState)
+	safeSpawns := tools.GenerateSafeSpawns(len(playerIDs), mapState, rng)
 	for i := range playerIDs {
-		playerMap[playerIDs[i]] = &PlayerIdentity{playerIDs[i], &tools.Circle{Center: safeSpawns[i], Radius: PUCK_RADIUS, Velocity: tools.Vector2{X: 0, Y: 0}}, playerUsernames[i]}
+		playerMap[playerIDs[i]] = &PlayerIdentity{
+			id:       playerIDs[i],
+			circle:   &tools.Circle{Center: safeSpawns[i], Radius: PUCK_RADIUS, Velocity: tools.Vector2{X: 0, Y: 0}},
+			username: playerUsernames[i],
+			alive:    true,
+			slot:     i,
+		}
 	}
 	walls := make([]*WallState, 0, 10)
 
 	gamestate := GameState{
-		players:   playerMap,
-		mapState:  mapState,
-		nextMap:   nextMap,
-		walls:     walls,
-		turnTimer: time.Duration(TURN_TIMER_IN_SECONDS) * time.Second,
+		players:     playerMap,
+		mapState:    mapState,
+		nextMap:     nextMap,
+		walls:       walls,
+		wallsPlaced: make(map[string]int, len(playerIDs)),
+		kills:       make(map[string]int, len(playerIDs)),
+		turnTimer:   turnTimer,
+		seed:        seed,
+		rng:         rng,
 	}
 
 	return &gamestate
 }
 
+// TurnTimerFromSeconds turns the turn timer requested by a lobby owner into a
+// duration, falling back to the server default when none was given and
+// clamping it to the allowed range otherwise.
+func TurnTimerFromSeconds(seconds int, defaultSeconds int) time.Duration {
+	if seconds <= 0 {
+		seconds = defaultSeconds
+	}
+	if seconds < MIN_TURN_TIMER_IN_SECONDS {
+		seconds = MIN_TURN_TIMER_IN_SECONDS
+	}
+	if seconds > MAX_TURN_TIMER_IN_SECONDS {
+		seconds = MAX_TURN_TIMER_IN_SECONDS
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// NewMatchSeed picks a seed for a match the owner started without one.
+func NewMatchSeed() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// SimulationSettleTime is how long clients should need to play back a shot
+// that took the given number of physics steps, plus some slack for latency.
+func SimulationSettleTime(steps int) time.Duration {
+	playback := time.Duration(steps) * time.Second / CLIENT_PHYSICS_STEPS_PER_SECOND
+	return playback + SIMULATION_GRACE_IN_MILLISECONDS*time.Millisecond
+}
+
 func PlayerMapToSlice(playerMap map[string]*PlayerIdentity) []PlayerIdentity {
 	players := make([]PlayerIdentity, 0, len(playerMap))
-	for _, player := range playerMap {
+	for _, player := range PlayerMapToSliceRef(playerMap) {
 		players = append(players, *player)
 	}
 	return players
 }
 
+// Standings ranks every player, best first. Players still in share first
+// place, the rest follow by how late they were knocked out.
+func (g *GameState) Standings() []Standing {
+	players := PlayerMapToSliceRef(g.players)
+	// still in first, then the latest knocked out; slot order breaks ties
+	slices.SortStableFunc(players, func(a, b *PlayerIdentity) int {
+		if a.alive != b.alive {
+			if a.alive {
+				return -1
+			}
+			return 1
+		}
+		return b.eliminatedOn - a.eliminatedOn
+	})
+	standings := make([]Standing, 0, len(players))
+	for i, p := range players {
+		placement := i + 1
+		if i > 0 && p.alive == players[i-1].alive && p.eliminatedOn == players[i-1].eliminatedOn {
+			placement = standings[i-1].Placement
+		}
+		standings = append(standings, Standing{
+			Placement:    placement,
+			Id:           p.id,
+			Username:     p.username,
+			EliminatedOn: p.eliminatedOn,
+			Knockouts:    g.kills[p.id],
+			Shots:        p.shots,
+			Distance:     math.Round(p.distance),
+		})
+	}
+	return standings
+}
+
+// PlayerMapToSliceRef lists the players by slot. The physics resolves
+// collisions in slice order, so the order has to be the same every time.
 func PlayerMapToSliceRef(playerMap map[string]*PlayerIdentity) []*PlayerIdentity {
 	players := make([]*PlayerIdentity, 0, len(playerMap))
 	for _, player := range playerMap {
 		players = append(players, player)
 	}
+	slices.SortFunc(players, func(a, b *PlayerIdentity) int { return a.slot - b.slot })
 	return players
 }
 
 func PlayerMapToCircles(playerMap map[string]*PlayerIdentity) []*tools.Circle {
-	playerSlice := PlayerMapToSliceRef(playerMap)
+	return IdentitiesToCircles(PlayerMapToSliceRef(playerMap))
+}
+
+// IdentitiesToCircles keeps the order of playerSlice, so an index into the
+// result (like the ones in tools.Contact) is an index into playerSlice too.
+func IdentitiesToCircles(playerSlice []*PlayerIdentity) []*tools.Circle {
 	circleSlice := make([]*tools.Circle, 0, len(playerSlice))
 	for i := range playerSlice {
 		circleSlice = append(circleSlice, playerSlice[i].circle)
@@ -137,7 +412,8 @@ func GetWallRectRefs(walls []*WallState) []*tools.Rect {
 		return rects
 	}
 	for i := range walls {
-		rects = append(rects, walls[i].rect)
+		rect := walls[i].Rect()
+		rects = append(rects, &rect)
 	}
 	return rects
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer runs a hub and its matchmaker behind a test server and
+// returns the websocket URL to dial.
+func newTestServer(t *testing.T) string {
+	t.Helper()
+	config := DefaultConfig()
+	config.ReplayDir = ""
+	store, err := OpenFileStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewHub(config, slog.New(slog.NewTextHandler(io.Discard, nil)), store)
+	go hub.Run()
+	go hub.matchmaker.Run()
+	server := httptest.NewServer(http.HandlerFunc(hub.ServeWs))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func dialTestServer(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestListLobbiesFloodDoesNotStallTheHub(t *testing.T) {
+	url := newTestServer(t)
+	flooder := dialTestServer(t, url)
+	for range 300 {
+		if err := flooder.WriteJSON(ClientMessage{Type: ClientListLobbies}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := dialTestServer(t, url)
+	if err := client.WriteJSON(ClientMessage{Type: ClientCreateRoom, Username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		msg := RoomCreatedMessage{}
+		if err := client.ReadJSON(&msg); err != nil {
+			t.Fatalf("no room-created while another client floods list-lobbies: %v", err)
+		}
+		if msg.Type == ServerRoomCreated {
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+)
+
+// newTestLobby seats players in a matched lobby whose game has just started.
+// Nothing runs the lobby, the test drives its states by hand.
+func newTestLobby(t *testing.T, ids ...string) (*Lobby, []*Player) {
+	t.Helper()
+	config := DefaultConfig()
+	config.ReplayDir = ""
+	store, err := OpenFileStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewHub(config, slog.New(slog.NewTextHandler(io.Discard, nil)), store)
+	hub.readLobby = make(chan LobbyMessage, 1)
+	players := make([]*Player, 0, len(ids))
+	for _, id := range ids {
+		players = append(players, newTestPlayer(id))
+	}
+	lobby := NewMatchedLobby(hub, "TEST", players)
+	t.Cleanup(lobby.StopTimer)
+	return lobby, players
+}
+
+// drainLobby empties a player's lobby queue and returns what was in it.
+func drainLobby(p *Player) []LobbyMessage {
+	msgs := make([]LobbyMessage, 0)
+	for {
+		select {
+		case lm := <-p.readLobby:
+			msgs = append(msgs, lm)
+		default:
+			return msgs
+		}
+	}
+}
+
+func TestTimedOutTurnsShrinkTheArena(t *testing.T) {
+	lobby, players := newTestLobby(t, "a", "b")
+	before := lobby.gameState.mapState
+
+	// three turns each, every one of them timing out
+	for turn := 1; turn <= 6; turn++ {
+		if _, ok := lobby.currentState.(LobbyInTurn); !ok {
+			t.Fatalf("turn %d: lobby is in %s, want in-turn", turn, stateName(lobby.currentState))
+		}
+		lobby.currentState.HandleTimeout(lobby)
+	}
+
+	if lobby.gameState.mapState == before {
+		t.Fatal("the arena didn't shrink after every player timed out three turns")
+	}
+	shrunk := false
+	for _, lm := range drainLobby(players[0]) {
+		shrunk = shrunk || lm.msgType == LobbySendMapUpdate
+	}
+	if !shrunk {
+		t.Error("players weren't sent the shrunk arena")
+	}
+}
+
+func TestDisconnectWhileDrainingClosesTheLobby(t *testing.T) {
+	lobby, players := newTestLobby(t, "a", "b")
+	lobby.SetState(lobby.processingturn)
+	lobby.currentState.HandleHubMessage(HubMessage{msgType: HubShutdown}, true, lobby)
+	if lobby.closed {
+		t.Fatal("lobby closed before the shot settled")
+	}
+
+	lobby.currentState.HandlePlayerMessage(PlayerMessage{msgType: PlayerDisconnected, player: players[1], senderID: players[1].id}, true, lobby)
+	if !lobby.closed {
+		t.Fatalf("lobby is still open in %s after its match ended during a shutdown", stateName(lobby.currentState))
+	}
+	select {
+	case lm := <-lobby.hub.readLobby:
+		if lm.msgType != LobbyClose {
+			t.Errorf("hub got lobby message %d, want LobbyClose", lm.msgType)
+		}
+	default:
+		t.Error("the hub wasn't told the lobby closed")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+)
+
+// NewLogger builds the server's logger from the log settings in config.
+// Lobby and player loggers are derived from it so every record about a match
+// carries the same lobby, player and state attributes.
+func NewLogger(config Config, w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: config.LogLevelValue()}
+	if config.LogFormat == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// stateName is a state's type name without the package or pointer, e.g.
+// "LobbyInTurn" or "PlayerInGame".
+func stateName(state any) string {
+	if state == nil {
+		return "none"
+	}
+	t := reflect.TypeOf(state)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+func parseLogLevel(v string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(strings.TrimSpace(v)))
+	return level, err
+}
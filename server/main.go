@@ -1,16 +1,99 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+const SHUTDOWN_FLUSH_IN_MILLISECONDS = 500
+
 func main() {
-	fmt.Println("here we fucking go")
-	hub := NewHub()
+	config, printConfig, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "config error: ", err)
+		os.Exit(2)
+	}
+	if printConfig {
+		out, _ := json.MarshalIndent(config, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	logger := NewLogger(config, os.Stderr)
+	slog.SetDefault(logger)
+
+	logger.Info("here we fucking go", "addr", config.ListenAddr, "tls", config.UseTLS())
+	store, err := OpenFileStore(config.StoreFile)
+	if err != nil {
+		logger.Error("couldn't open the store", "path", config.StoreFile, "err", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	hub := NewHub(config, logger, store)
 	go hub.Run()
+	go hub.matchmaker.Run()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", hub.ServeWs)
+	mux.Handle("/metrics", hub.metrics)
+	mux.HandleFunc("GET /replay/{id}", hub.ServeReplay)
+	mux.HandleFunc("GET /lobbies", hub.ServeLobbies)
+	mux.HandleFunc("GET /leaderboard", hub.ServeLeaderboard)
+	mux.HandleFunc("GET /players/{id}/matches", hub.ServePlayerMatches)
+	mux.HandleFunc("GET /matches/{id}", hub.ServeMatch)
+	server := &http.Server{Addr: config.ListenAddr, Handler: mux}
+
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if config.UseTLS() {
+			serveErr <- server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err = <-serveErr:
+		logger.Error("server stopped", "err", err)
+		os.Exit(1)
+	case <-stop.Done():
+	}
+
+	Shutdown(server, hub, config.ShutdownTimeout(), logger)
+}
+
+// Shutdown stops new connections, lets lobbies finish the shot they are on and
+// close, then returns. It gives up waiting once timeout has passed.
+func Shutdown(server *http.Server, hub *Hub, timeout time.Duration, logger *slog.Logger) {
+	logger.Info("shutting down, giving lobbies time to wrap up", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	http.HandleFunc("/ws", hub.ServeWs)
+	// websocket connections are hijacked, so this only closes the listener
+	// and idle http connections; the hub deals with the players.
+	err := server.Shutdown(ctx)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		logger.Warn("http shutdown", "err", err)
+	}
 
-	http.ListenAndServe("localhost:8000", nil)
+	select {
+	case <-hub.Shutdown(timeout):
+		logger.Info("every lobby closed")
+		// give the write pumps a moment to flush the lobby-closed messages
+		time.Sleep(SHUTDOWN_FLUSH_IN_MILLISECONDS * time.Millisecond)
+	case <-ctx.Done():
+		logger.Warn("shutdown deadline passed with lobbies still open")
+	}
 }
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"math"
+	"slices"
+	"time"
+)
+
+const (
+	MATCH_MIN_PLAYERS          = 2
+	MATCH_MAX_PLAYERS          = 8
+	MAX_RATING_WINDOW          = 1000.0 // however long someone waits, they won't face anyone further off than this
+	READY_CHECK_IN_SECONDS     = 15
+	MATCHMAKER_TICK_IN_SECONDS = 1
+	DEFAULT_RATING             = 1000.0
+)
+
+// Clock is where the matchmaker reads the time, so tests can move it by hand.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// QueueEntry is one player waiting for a match.
+type QueueEntry struct {
+	player   *Player
+	rating   float64
+	enqueued time.Time
+}
+
+// MatchQueue holds the players waiting for a match and groups them by rating.
+// Each player accepts opponents within a window around their own rating that
+// starts at baseWindow and widens by windowGrowth every second they wait. It
+// is not safe for concurrent use; the Matchmaker goroutine owns it.
+type MatchQueue struct {
+	clock        Clock
+	entries      []*QueueEntry // oldest first
+	minPlayers   int
+	maxPlayers   int
+	baseWindow   float64
+	windowGrowth float64       // rating points per second waited
+	fillWait     time.Duration // how long a group may wait for more players before it settles for fewer
+}
+
+func NewMatchQueue(clock Clock, config Config) *MatchQueue {
+	return &MatchQueue{
+		clock:        clock,
+		minPlayers:   max(MATCH_MIN_PLAYERS, config.MinLobbyPlayers),
+		maxPlayers:   min(MATCH_MAX_PLAYERS, config.MaxLobbyPlayers),
+		baseWindow:   config.RatingWindow,
+		windowGrowth: config.RatingWindowGrowth,
+		fillWait:     time.Duration(config.MatchFillSeconds) * time.Second,
+	}
+}
+
+// Add puts a player at the back of the queue.
+func (q *MatchQueue) Add(player *Player, rating float64) {
+	q.Requeue(&QueueEntry{player: player, rating: rating, enqueued: q.clock.Now()})
+}
+
+// Requeue puts an entry back where its enqueue time says it belongs, so a
+// player whose ready check fell through doesn't lose their place.
+func (q *MatchQueue) Requeue(entry *QueueEntry) {
+	i := slices.IndexFunc(q.entries, func(e *QueueEntry) bool { return e.enqueued.After(entry.enqueued) })
+	if i < 0 {
+		i = len(q.entries)
+	}
+	q.entries = slices.Insert(q.entries, i, entry)
+}
+
+// Remove takes a player out of the queue and reports whether they were in it.
+func (q *MatchQueue) Remove(playerID string) bool {
+	n := len(q.entries)
+	q.entries = slices.DeleteFunc(q.entries, func(e *QueueEntry) bool { return e.player.id == playerID })
+	return len(q.entries) != n
+}
+
+func (q *MatchQueue) Contains(playerID string) bool {
+	return slices.ContainsFunc(q.entries, func(e *QueueEntry) bool { return e.player.id == playerID })
+}
+
+func (q *MatchQueue) Len() int {
+	return len(q.entries)
+}
+
+// Window is how far from their own rating a player will accept opponents at now.
+func (q *MatchQueue) Window(entry *QueueEntry, now time.Time) float64 {
+	waited := now.Sub(entry.enqueued).Seconds()
+	return min(q.baseWindow+q.windowGrowth*waited, MAX_RATING_WINDOW)
+}
+
+// Match takes groups of players who all fit in each other's windows out of the
+// queue. The longest waiting player is matched first. A group is taken once
+// it is full, or once its first player has waited fillWait and it has at
+// least minPlayers.
+func (q *MatchQueue) Match() [][]*QueueEntry {
+	now := q.clock.Now()
+	groups := make([][]*QueueEntry, 0)
+	taken := make(map[*QueueEntry]bool)
+	for _, anchor := range q.entries {
+		if taken[anchor] {
+			continue
+		}
+		candidates := make([]*QueueEntry, 0, len(q.entries))
+		for _, e := range q.entries {
+			if e != anchor && !taken[e] {
+				candidates = append(candidates, e)
+			}
+		}
+		// closest ratings first, so the group stays as even as it can
+		slices.SortStableFunc(candidates, func(a, b *QueueEntry) int {
+			return cmp.Compare(math.Abs(a.rating-anchor.rating), math.Abs(b.rating-anchor.rating))
+		})
+		group := []*QueueEntry{anchor}
+		for _, c := range candidates {
+			if len(group) == q.maxPlayers {
+				break
+			}
+			if q.fits(c, group, now) {
+				group = append(group, c)
+			}
+		}
+		if len(group) < q.minPlayers {
+			continue
+		}
+		if len(group) < q.maxPlayers && now.Sub(anchor.enqueued) < q.fillWait {
+			continue
+		}
+		for _, e := range group {
+			taken[e] = true
+		}
+		groups = append(groups, group)
+	}
+	q.entries = slices.DeleteFunc(q.entries, func(e *QueueEntry) bool { return taken[e] })
+	return groups
+}
+
+// fits reports whether entry and everyone in group are inside each other's windows.
+func (q *MatchQueue) fits(entry *QueueEntry, group []*QueueEntry, now time.Time) bool {
+	for _, g := range group {
+		gap := math.Abs(entry.rating - g.rating)
+		if gap > q.Window(entry, now) || gap > q.Window(g, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadyCheck is a group the queue matched, waiting for everyone to confirm.
+type ReadyCheck struct {
+	entries  []*QueueEntry
+	accepted map[string]bool
+	deadline time.Time
+}
+
+func (c *ReadyCheck) AllAccepted() bool {
+	return len(c.accepted) == len(c.entries)
+}
+
+// Matchmaker runs the match queue next to the Hub. Players talk to it through
+// readPlayer; once a ready check passes it hands the group to the hub, which
+// opens a lobby for them.
+type Matchmaker struct {
+	hub        *Hub
+	queue      *MatchQueue
+	readPlayer chan PlayerMessage
+	checks     map[string]*ReadyCheck // player id -> the ready check they are in
+	log        *slog.Logger
+}
+
+func NewMatchmaker(hub *Hub, clock Clock) *Matchmaker {
+	return &Matchmaker{
+		hub:        hub,
+		queue:      NewMatchQueue(clock, hub.config),
+		readPlayer: make(chan PlayerMessage),
+		checks:     make(map[string]*ReadyCheck),
+		log:        hub.log.With("component", "matchmaker"),
+	}
+}
+
+func (m *Matchmaker) Run() {
+	ticker := time.NewTicker(MATCHMAKER_TICK_IN_SECONDS * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case pm := <-m.readPlayer:
+			m.HandlePlayerMessage(pm)
+		case <-ticker.C:
+			m.Tick()
+		}
+	}
+}
+
+func (m *Matchmaker) HandlePlayerMessage(pm PlayerMessage) {
+	switch pm.msgType {
+	case PlayerJoinQueue:
+		if m.hub.draining.Load() {
+			pm.player.QueueHubMessage(HubMessage{msgType: HubServerShuttingDown})
+			return
+		}
+		if m.queue.Contains(pm.senderID) || m.checks[pm.senderID] != nil {
+			return
+		}
+		m.queue.Add(pm.player, pm.rating)
+		m.log.Info("player joined the match queue", "player", pm.senderID, "rating", pm.rating, "queued", m.queue.Len())
+		m.hub.metrics.MatchQueueChanged(m.queue.Len())
+		pm.player.QueueHubMessage(HubMessage{msgType: HubQueued})
+	case PlayerLeaveQueue, PlayerDisconnected:
+		if m.queue.Remove(pm.senderID) {
+			m.log.Info("player left the match queue", "player", pm.senderID)
+			m.hub.metrics.MatchQueueChanged(m.queue.Len())
+		}
+		if check := m.checks[pm.senderID]; check != nil {
+			// nobody is listening for the result on the leaver's side
+			delete(m.checks, pm.senderID)
+			check.entries = slices.DeleteFunc(check.entries, func(e *QueueEntry) bool { return e.player.id == pm.senderID })
+			m.FailCheck(check, nil, "player-left")
+		}
+	case PlayerReadyAccept:
+		check := m.checks[pm.senderID]
+		if check == nil {
+			return
+		}
+		check.accepted[pm.senderID] = true
+		if check.AllAccepted() {
+			m.PassCheck(check)
+		}
+	case PlayerReadyDecline:
+		if check := m.checks[pm.senderID]; check != nil {
+			m.FailCheck(check, []string{pm.senderID}, "player-declined")
+		}
+	}
+}
+
+// Tick drops ready checks that ran out of time and starts new ones for
+// whatever the queue can match now.
+func (m *Matchmaker) Tick() {
+	now := m.queue.clock.Now()
+	expired := make(map[*ReadyCheck]bool)
+	for _, check := range m.checks {
+		if now.After(check.deadline) {
+			expired[check] = true
+		}
+	}
+	for check := range expired {
+		missing := make([]string, 0)
+		for _, e := range check.entries {
+			if !check.accepted[e.player.id] {
+				missing = append(missing, e.player.id)
+			}
+		}
+		m.FailCheck(check, missing, "ready-check-timeout")
+	}
+
+	groups := m.queue.Match()
+	if len(groups) > 0 {
+		m.hub.metrics.MatchQueueChanged(m.queue.Len())
+	}
+	for _, group := range groups {
+		check := &ReadyCheck{
+			entries:  group,
+			accepted: make(map[string]bool),
+			deadline: now.Add(READY_CHECK_IN_SECONDS * time.Second),
+		}
+		for _, e := range group {
+			m.checks[e.player.id] = check
+			e.player.QueueHubMessage(HubMessage{msgType: HubReadyCheck, countdown: READY_CHECK_IN_SECONDS * time.Second, players: len(group)})
+		}
+		m.log.Info("ready check started", "players", len(group))
+	}
+}
+
+// PassCheck hands a group where everyone accepted to the hub.
+func (m *Matchmaker) PassCheck(check *ReadyCheck) {
+	players := make([]*Player, 0, len(check.entries))
+	for _, e := range check.entries {
+		delete(m.checks, e.player.id)
+		players = append(players, e.player)
+	}
+	m.log.Info("match found", "players", len(players))
+	m.hub.readMatch <- players
+}
+
+// FailCheck calls a ready check off. The players in dropped leave the queue;
+// everyone else goes back in, keeping their place.
+func (m *Matchmaker) FailCheck(check *ReadyCheck, dropped []string, reason string) {
+	m.log.Info("ready check failed", "reason", reason, "dropped", dropped)
+	for _, e := range check.entries {
+		delete(m.checks, e.player.id)
+		requeued := !slices.Contains(dropped, e.player.id)
+		if requeued {
+			m.queue.Requeue(e)
+		}
+		e.player.QueueHubMessage(HubMessage{msgType: HubReadyCheckFailed, reason: reason, requeued: requeued})
+	}
+	m.hub.metrics.MatchQueueChanged(m.queue.Len())
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when the test says so.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+}
+
+func newTestPlayer(id string) *Player {
+	return &Player{
+		id:        id,
+		username:  id,
+		readHub:   make(chan HubMessage, HUB_QUEUE_SIZE),
+		readLobby: make(chan LobbyMessage, LOBBY_QUEUE_SIZE),
+		lagging:   make(chan struct{}, 1),
+		log:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+func newTestMatchmaker(config Config, clock Clock) *Matchmaker {
+	hub := NewHub(config, slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	hub.readMatch = make(chan []*Player, 1)
+	return NewMatchmaker(hub, clock)
+}
+
+// expectHub takes the next hub message the player got and checks its type.
+func expectHub(t *testing.T, p *Player, msgType HubMessageType) HubMessage {
+	t.Helper()
+	select {
+	case hm := <-p.readHub:
+		if hm.msgType != msgType {
+			t.Fatalf("%s got hub message %d, want %d", p.id, hm.msgType, msgType)
+		}
+		return hm
+	default:
+		t.Fatalf("%s got no hub message, want %d", p.id, msgType)
+		return HubMessage{}
+	}
+}
+
+func queueOrder(q *MatchQueue) []string {
+	ids := make([]string, 0, len(q.entries))
+	for _, e := range q.entries {
+		ids = append(ids, e.player.id)
+	}
+	return ids
+}
+
+func TestMatchQueueWindow(t *testing.T) {
+	clock := newTestClock()
+	q := NewMatchQueue(clock, DefaultConfig())
+	q.Add(newTestPlayer("a"), 1000)
+	entry := q.entries[0]
+
+	if got := q.Window(entry, clock.Now()); got != 100 {
+		t.Errorf("window right away is %v, want 100", got)
+	}
+	clock.Advance(15 * time.Second)
+	if got := q.Window(entry, clock.Now()); got != 250 {
+		t.Errorf("window after 15s is %v, want 250", got)
+	}
+	clock.Advance(time.Hour)
+	if got := q.Window(entry, clock.Now()); got != MAX_RATING_WINDOW {
+		t.Errorf("window after an hour is %v, want the cap %v", got, MAX_RATING_WINDOW)
+	}
+}
+
+func TestMatchQueueRatingGap(t *testing.T) {
+	clock := newTestClock()
+	config := DefaultConfig()
+	config.MatchFillSeconds = 0
+	q := NewMatchQueue(clock, config)
+	q.Add(newTestPlayer("a"), 1000)
+	q.Add(newTestPlayer("b"), 1250)
+
+	if groups := q.Match(); len(groups) != 0 {
+		t.Fatalf("matched %d groups 250 points apart straight away", len(groups))
+	}
+	// both windows reach 250 after 15 seconds
+	clock.Advance(15 * time.Second)
+	if groups := q.Match(); len(groups) != 1 || len(groups[0]) != 2 {
+		t.Fatalf("got groups %v once the windows had widened, want one pair", groups)
+	}
+	if q.Len() != 0 {
+		t.Errorf("%d players left in the queue", q.Len())
+	}
+}
+
+func TestMatchQueueFillWait(t *testing.T) {
+	clock := newTestClock()
+	config := DefaultConfig()
+	config.MaxLobbyPlayers = 4
+	q := NewMatchQueue(clock, config)
+	for _, id := range []string{"a", "b", "c"} {
+		q.Add(newTestPlayer(id), 1000)
+		clock.Advance(time.Second)
+	}
+
+	if groups := q.Match(); len(groups) != 0 {
+		t.Fatalf("matched %d groups of 3 before the fill wait", len(groups))
+	}
+	clock.Advance(time.Duration(config.MatchFillSeconds) * time.Second)
+	groups := q.Match()
+	if len(groups) != 1 || len(groups[0]) != 3 {
+		t.Fatalf("got groups %v after the fill wait, want one group of 3", groups)
+	}
+
+	// a full group doesn't wait
+	for _, id := range []string{"d", "e", "f", "g"} {
+		q.Add(newTestPlayer(id), 1000)
+	}
+	if groups := q.Match(); len(groups) != 1 || len(groups[0]) != 4 {
+		t.Fatalf("got groups %v for a full queue, want one group of 4", groups)
+	}
+}
+
+func TestMatchQueueRequeue(t *testing.T) {
+	clock := newTestClock()
+	q := NewMatchQueue(clock, DefaultConfig())
+	for _, id := range []string{"a", "b", "c"} {
+		q.Add(newTestPlayer(id), 1000)
+		clock.Advance(time.Second)
+	}
+	entry := q.entries[1]
+	q.Remove("b")
+	clock.Advance(time.Minute)
+	q.Add(newTestPlayer("d"), 1000)
+
+	q.Requeue(entry)
+	want := []string{"a", "b", "c", "d"}
+	if got := queueOrder(q); !slices.Equal(got, want) {
+		t.Errorf("queue is %v after requeueing b, want %v", got, want)
+	}
+}
+
+// startReadyCheck queues two players and lets the matchmaker match them.
+func startReadyCheck(t *testing.T) (*Matchmaker, *fakeClock, *Player, *Player) {
+	t.Helper()
+	clock := newTestClock()
+	config := DefaultConfig()
+	config.MatchFillSeconds = 0
+	m := newTestMatchmaker(config, clock)
+	a, b := newTestPlayer("a"), newTestPlayer("b")
+	for _, p := range []*Player{a, b} {
+		m.HandlePlayerMessage(PlayerMessage{msgType: PlayerJoinQueue, player: p, senderID: p.id, rating: DEFAULT_RATING})
+		expectHub(t, p, HubQueued)
+		clock.Advance(time.Second)
+	}
+	m.Tick()
+	for _, p := range []*Player{a, b} {
+		if hm := expectHub(t, p, HubReadyCheck); hm.players != 2 {
+			t.Fatalf("ready check for %d players, want 2", hm.players)
+		}
+	}
+	return m, clock, a, b
+}
+
+func TestReadyCheckPasses(t *testing.T) {
+	m, _, a, b := startReadyCheck(t)
+	m.HandlePlayerMessage(PlayerMessage{msgType: PlayerReadyAccept, player: a, senderID: a.id})
+	m.HandlePlayerMessage(PlayerMessage{msgType: PlayerReadyAccept, player: b, senderID: b.id})
+
+	select {
+	case players := <-m.hub.readMatch:
+		if len(players) != 2 {
+			t.Fatalf("hub got %d players, want 2", len(players))
+		}
+	default:
+		t.Fatal("hub got no match")
+	}
+	if len(m.checks) != 0 {
+		t.Errorf("%d ready checks left over", len(m.checks))
+	}
+}
+
+func TestReadyCheckTimeout(t *testing.T) {
+	m, clock, a, b := startReadyCheck(t)
+	m.HandlePlayerMessage(PlayerMessage{msgType: PlayerReadyAccept, player: a, senderID: a.id})
+	clock.Advance(READY_CHECK_IN_SECONDS * time.Second)
+	m.Tick()
+	if len(a.readHub) != 0 || len(b.readHub) != 0 {
+		t.Fatal("ready check failed before its deadline")
+	}
+
+	clock.Advance(time.Second)
+	m.Tick()
+	if hm := expectHub(t, a, HubReadyCheckFailed); hm.reason != "ready-check-timeout" || !hm.requeued {
+		t.Errorf("a got %q requeued=%v, want ready-check-timeout and requeued", hm.reason, hm.requeued)
+	}
+	if hm := expectHub(t, b, HubReadyCheckFailed); hm.reason != "ready-check-timeout" || hm.requeued {
+		t.Errorf("b got %q requeued=%v, want ready-check-timeout and dropped", hm.reason, hm.requeued)
+	}
+	if got := queueOrder(m.queue); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("queue is %v, want [a]", got)
+	}
+}
+
+func TestReadyCheckDecline(t *testing.T) {
+	m, _, a, b := startReadyCheck(t)
+	m.HandlePlayerMessage(PlayerMessage{msgType: PlayerReadyDecline, player: b, senderID: b.id})
+
+	if hm := expectHub(t, a, HubReadyCheckFailed); hm.reason != "player-declined" || !hm.requeued {
+		t.Errorf("a got %q requeued=%v, want player-declined and requeued", hm.reason, hm.requeued)
+	}
+	if hm := expectHub(t, b, HubReadyCheckFailed); hm.requeued {
+		t.Error("b declined but was requeued")
+	}
+	if got := queueOrder(m.queue); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("queue is %v, want [a]", got)
+	}
+}
+
+func TestReadyCheckLeave(t *testing.T) {
+	m, _, a, b := startReadyCheck(t)
+	m.HandlePlayerMessage(PlayerMessage{msgType: PlayerLeaveQueue, player: b, senderID: b.id})
+
+	if hm := expectHub(t, a, HubReadyCheckFailed); hm.reason != "player-left" || !hm.requeued {
+		t.Errorf("a got %q requeued=%v, want player-left and requeued", hm.reason, hm.requeued)
+	}
+	if len(b.readHub) != 0 {
+		t.Error("the player who left was told about the ready check")
+	}
+	if got := queueOrder(m.queue); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("queue is %v, want [a]", got)
+	}
+	if len(m.checks) != 0 {
+		t.Errorf("%d ready checks left over", len(m.checks))
+	}
+}
+
+// expectSeat checks whether the player was given a seat in a lobby.
+func expectSeat(t *testing.T, p *Player, seated bool) LobbyMessage {
+	t.Helper()
+	select {
+	case lm := <-p.readLobby:
+		if !seated || lm.msgType != LobbyAcceptPlayer {
+			t.Fatalf("%s got lobby message %d, want no seat", p.id, lm.msgType)
+		}
+		return lm
+	default:
+		if seated {
+			t.Fatalf("%s got no seat", p.id)
+		}
+		return LobbyMessage{}
+	}
+}
+
+func TestMatchLeavesOutDisconnectedPlayers(t *testing.T) {
+	m := newTestMatchmaker(DefaultConfig(), newTestClock())
+	a, b, c := newTestPlayer("a"), newTestPlayer("b"), newTestPlayer("c")
+	// c disconnected after the ready check passed
+	connected := map[string]*Player{"a": a, "b": b}
+
+	lobby := m.hub.OpenMatch([]*Player{a, b, c}, connected)
+	if lobby == nil {
+		t.Fatal("no lobby for the two players still connected")
+	}
+	defer lobby.StopTimer()
+	if len(lobby.players) != 2 || lobby.players["c"] != nil {
+		t.Errorf("lobby seated %d players, want a and b", len(lobby.players))
+	}
+	expectSeat(t, a, true)
+	expectSeat(t, b, true)
+	expectSeat(t, c, false)
+}
+
+func TestMatchFallsThroughWithTooFewPlayers(t *testing.T) {
+	m := newTestMatchmaker(DefaultConfig(), newTestClock())
+	a, b := newTestPlayer("a"), newTestPlayer("b")
+
+	if lobby := m.hub.OpenMatch([]*Player{a, b}, map[string]*Player{"a": a}); lobby != nil {
+		t.Fatal("opened a lobby for one player")
+	}
+	if hm := expectHub(t, a, HubReadyCheckFailed); hm.reason != "player-left" || hm.requeued {
+		t.Errorf("a got %q requeued=%v, want player-left and dropped", hm.reason, hm.requeued)
+	}
+	expectSeat(t, a, false)
+	if len(b.readHub) != 0 {
+		t.Error("the player who disconnected was told about the match")
+	}
+}
+
+func TestPlayerWhoLeftTheQueueHandsBackTheSeat(t *testing.T) {
+	m := newTestMatchmaker(DefaultConfig(), newTestClock())
+	a, b := newTestPlayer("a"), newTestPlayer("b")
+	lobby := m.hub.OpenMatch([]*Player{a, b}, map[string]*Player{"a": a, "b": b})
+	defer lobby.StopTimer()
+
+	// b sent leave-queue after the ready check passed and is back in the hub
+	b.state = &PlayerInHub{}
+	accept := expectSeat(t, b, true)
+	go b.state.HandleLobbyMessage(accept, true, b)
+	select {
+	case pm := <-lobby.Inbound:
+		if pm.msgType != PlayerDisconnected || pm.player != b {
+			t.Errorf("lobby got message %d from %s, want b forfeiting", pm.msgType, pm.senderID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the player kept a seat it doesn't want")
+	}
+}
+
+func TestDisconnectingPlayerHandsBackTheSeat(t *testing.T) {
+	m := newTestMatchmaker(DefaultConfig(), newTestClock())
+	a, b := newTestPlayer("a"), newTestPlayer("b")
+	// the hub opened the lobby before it took b's end of session
+	lobby := m.hub.OpenMatch([]*Player{a, b}, map[string]*Player{"a": a, "b": b})
+	defer lobby.StopTimer()
+
+	b.hub = m.hub
+	go b.Disconnect()
+	if pm := <-m.hub.readPlayer; pm.msgType != PlayerEndSession {
+		t.Fatalf("hub got message %d, want the end of b's session", pm.msgType)
+	}
+	select {
+	case pm := <-lobby.Inbound:
+		if pm.msgType != PlayerDisconnected || pm.player != b {
+			t.Errorf("lobby got message %d from %s, want b forfeiting", pm.msgType, pm.senderID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the disconnected player kept its seat")
+	}
+}
+
+func TestMatchmakerDoesNotWaitOnAFullQueue(t *testing.T) {
+	m := newTestMatchmaker(DefaultConfig(), newTestClock())
+	p := newTestPlayer("a")
+	for range HUB_QUEUE_SIZE {
+		p.readHub <- HubMessage{msgType: HubQueued}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.HandlePlayerMessage(PlayerMessage{msgType: PlayerJoinQueue, player: p, senderID: p.id, rating: DEFAULT_RATING})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("matchmaker blocked on a player that isn't reading its queue")
+	}
+	select {
+	case <-p.lagging:
+	default:
+		t.Error("the player wasn't told to drop its connection")
+	}
+}
@@ -1,25 +1,46 @@
 package main
 
-import "github.com/Tacoman44444/killiardsgame/server/tools"
+import (
+	"math"
+	"time"
+
+	"github.com/Tacoman44444/killiardsgame/server/tools"
+)
 
 type ServerMessageType string
 
 const (
-	ServerRoomCreated   ServerMessageType = "room-created"
-	ServerRoomJoined    ServerMessageType = "room-joined"
-	ServerInvalidCode   ServerMessageType = "invalid-code"
-	ServerMakeOwner     ServerMessageType = "make-owner"
-	ServerGameStart     ServerMessageType = "game-start"
-	ServerTurnStart     ServerMessageType = "turn-started"
-	ServerTurnTimeout   ServerMessageType = "turn-timeout"
-	ServerBroadcastTurn ServerMessageType = "broadcast-turn"
-	ServerEntityUpdate  ServerMessageType = "entity-update"
-	ServerEliminations  ServerMessageType = "e"
-	ServerWallUpdate    ServerMessageType = "wall-update"
-	ServerMapUpdate     ServerMessageType = "map-update"
-	ServerGameFinished  ServerMessageType = "game-finished"
-	ServerLobbyClosed   ServerMessageType = "lobby-closed"
-	ServerReturnToLobby ServerMessageType = "return-to-lobby"
+	ServerRoomCreated    ServerMessageType = "room-created"
+	ServerRoomJoined     ServerMessageType = "room-joined"
+	ServerInvalidCode    ServerMessageType = "invalid-code"
+	ServerMakeOwner      ServerMessageType = "make-owner"
+	ServerGameStart      ServerMessageType = "game-start"
+	ServerTurnStart      ServerMessageType = "turn-started"
+	ServerTurnTimeout    ServerMessageType = "turn-timeout"
+	ServerBroadcastTurn  ServerMessageType = "broadcast-turn"
+	ServerEntityUpdate   ServerMessageType = "entity-update"
+	ServerEliminations   ServerMessageType = "e"
+	ServerWallUpdate     ServerMessageType = "wall-update"
+	ServerMapUpdate      ServerMessageType = "map-update"
+	ServerGameFinished   ServerMessageType = "game-finished"
+	ServerLobbyClosed    ServerMessageType = "lobby-closed"
+	ServerReturnToLobby  ServerMessageType = "return-to-lobby"
+	ServerResumed        ServerMessageType = "session-resumed"
+	ServerResumeFailed   ServerMessageType = "resume-failed"
+	ServerSessionToken   ServerMessageType = "session-token"
+	ServerStateSnapshot  ServerMessageType = "state-snapshot"
+	ServerJoinRejected   ServerMessageType = "join-rejected"
+	ServerShuttingDown   ServerMessageType = "server-shutting-down"
+	ServerActionRejected ServerMessageType = "action-rejected"
+	ServerShotTrajectory ServerMessageType = "shot-trajectory"
+	ServerSpectating     ServerMessageType = "spectating"
+	ServerLobbyList      ServerMessageType = "lobby-list"
+	ServerQueued         ServerMessageType = "queued"
+	ServerLeftQueue      ServerMessageType = "left-queue"
+	ServerReadyCheck     ServerMessageType = "ready-check"
+	ServerReadyCheckFail ServerMessageType = "ready-check-failed"
+	ServerLoggedIn       ServerMessageType = "logged-in"
+	ServerLoginFailed    ServerMessageType = "login-failed"
 )
 
 type ServerMessage interface {
@@ -27,16 +48,82 @@ type ServerMessage interface {
 }
 
 type RoomCreatedMessage struct {
-	Type ServerMessageType `json:"type"`
-	Code string            `json:"code"`
+	Type  ServerMessageType `json:"type"`
+	Code  string            `json:"code"`
+	Token string            `json:"token"`
 }
 
 func (m RoomCreatedMessage) isServerMessage() {}
 
-type RoomJoinedMessage struct {
+// SpectatingMessage confirms a join-as-spectator. A state-snapshot follows.
+type SpectatingMessage struct {
+	Type  ServerMessageType `json:"type"`
+	Code  string            `json:"code"`
+	Token string            `json:"token"`
+}
+
+func (m SpectatingMessage) isServerMessage() {}
+
+type LobbyListMessage struct {
+	Type    ServerMessageType `json:"type"`
+	Lobbies []LobbyInfo       `json:"lobbies"`
+}
+
+func (m LobbyListMessage) isServerMessage() {}
+
+// LoggedInMessage answers register, login and guest-login. GuestToken is only
+// set when guest-login made a new guest; the client has to keep it to log back in.
+type LoggedInMessage struct {
+	Type       ServerMessageType `json:"type"`
+	Profile    Profile           `json:"profile"`
+	GuestToken string            `json:"guest_token,omitempty"`
+}
+
+func (m LoggedInMessage) isServerMessage() {}
+
+type LoginFailedMessage struct {
+	Type   ServerMessageType `json:"type"`
+	Reason string            `json:"reason"`
+}
+
+func (m LoginFailedMessage) isServerMessage() {}
+
+type QueuedMessage struct {
+	Type ServerMessageType `json:"type"`
+}
+
+func (m QueuedMessage) isServerMessage() {}
+
+type LeftQueueMessage struct {
 	Type ServerMessageType `json:"type"`
 }
 
+func (m LeftQueueMessage) isServerMessage() {}
+
+// ReadyCheckMessage asks a queued player to confirm the match the matchmaker
+// found with ready-accept or ready-decline before Seconds run out.
+type ReadyCheckMessage struct {
+	Type    ServerMessageType `json:"type"`
+	Players int               `json:"players"`
+	Seconds int               `json:"seconds"`
+}
+
+func (m ReadyCheckMessage) isServerMessage() {}
+
+type ReadyCheckFailedMessage struct {
+	Type     ServerMessageType `json:"type"`
+	Reason   string            `json:"reason"`
+	Requeued bool              `json:"requeued"` // the player is still in the queue
+}
+
+func (m ReadyCheckFailedMessage) isServerMessage() {}
+
+type RoomJoinedMessage struct {
+	Type  ServerMessageType `json:"type"`
+	Code  string            `json:"code"`
+	Token string            `json:"token"`
+}
+
 func (m RoomJoinedMessage) isServerMessage() {}
 
 type InvalidCodeMessage struct {
@@ -45,6 +132,33 @@ type InvalidCodeMessage struct {
 
 func (m InvalidCodeMessage) isServerMessage() {}
 
+type JoinRejectedMessage struct {
+	Type   ServerMessageType `json:"type"`
+	Reason string            `json:"reason"`
+}
+
+func (m JoinRejectedMessage) isServerMessage() {}
+
+type ActionRejectedMessage struct {
+	Type   ServerMessageType `json:"type"`
+	Reason string            `json:"reason"`
+}
+
+func (m ActionRejectedMessage) isServerMessage() {}
+
+// ShotTrajectoryMessage lets clients play a shot back exactly as the server
+// resolved it. Each frame lists x then y for every id in Ids, in that order.
+type ShotTrajectoryMessage struct {
+	Type           ServerMessageType `json:"type"`
+	Shooter        string            `json:"shooter"`
+	Ids            []string          `json:"ids"`
+	StepsPerSecond int               `json:"steps_per_second"`
+	StepInterval   int               `json:"step_interval"`
+	Frames         [][]float64       `json:"frames"`
+}
+
+func (m ShotTrajectoryMessage) isServerMessage() {}
+
 type MakeOwnerMessage struct {
 	Type ServerMessageType `json:"type"`
 }
@@ -57,6 +171,7 @@ type GameStartMessage struct {
 	NextMap      tools.MapState         `json:"next_map"`
 	Player       ClientPlayerIdentity   `json:"player"`
 	OtherPlayers []ClientPlayerIdentity `json:"other_players"`
+	Seed         string                 `json:"seed"` // replays the same board when passed to start-game
 }
 
 func (m GameStartMessage) isServerMessage() {}
@@ -70,6 +185,7 @@ func (m TurnStartMessage) isServerMessage() {}
 
 type TurnTimeoutMessage struct {
 	Type ServerMessageType `json:"type"`
+	Id   string            `json:"id"`
 }
 
 func (m TurnTimeoutMessage) isServerMessage() {}
@@ -93,7 +209,8 @@ func (m EntityUpdateMessage) isServerMessage() {}
 
 type EliminationMessage struct {
 	Type         ServerMessageType      `json:"type"`
-	Eliminations []ClientPlayerIdentity `json:"eliminated_players"`
+	Eliminations []ClientPlayerIdentity `json:"eliminated_players"` // last_touched_by says who knocked each one out
+	TurnNumber   int                    `json:"turn_number"`
 }
 
 func (m EliminationMessage) isServerMessage() {}
@@ -117,6 +234,8 @@ type GameFinishedMessage struct {
 	Type       ServerMessageType `json:"type"`
 	Result     string            `json:"result"` //win or draw
 	WinnerName string            `json:"winner_name"`
+	Kills      map[string]int    `json:"kills"` // player id -> pucks they knocked out
+	Standings  []Standing        `json:"standings"`
 }
 
 func (m GameFinishedMessage) isServerMessage() {}
@@ -133,34 +252,132 @@ type ReturnToLobbyMessage struct {
 
 func (m ReturnToLobbyMessage) isServerMessage() {}
 
+type ServerShuttingDownMessage struct {
+	Type             ServerMessageType `json:"type"`
+	SecondsRemaining int               `json:"seconds_remaining"`
+}
+
+func (m ServerShuttingDownMessage) isServerMessage() {}
+
+type SessionResumedMessage struct {
+	Type ServerMessageType `json:"type"`
+	Id   string            `json:"id"`
+	Code string            `json:"code"`
+}
+
+func (m SessionResumedMessage) isServerMessage() {}
+
+// SessionTokenMessage replaces the token the client would resume with.
+type SessionTokenMessage struct {
+	Type  ServerMessageType `json:"type"`
+	Token string            `json:"token"`
+}
+
+func (m SessionTokenMessage) isServerMessage() {}
+
+type ResumeFailedMessage struct {
+	Type ServerMessageType `json:"type"`
+}
+
+func (m ResumeFailedMessage) isServerMessage() {}
+
+type StateSnapshotMessage struct {
+	Type          ServerMessageType      `json:"type"`
+	Code          string                 `json:"code"`
+	InGame        bool                   `json:"in_game"`
+	CurrentMap    tools.MapState         `json:"current_map"`
+	NextMap       tools.MapState         `json:"next_map"`
+	AllPlayers    []ClientPlayerIdentity `json:"all_players"`
+	Walls         []WallState            `json:"walls"`
+	CurrentPlayer string                 `json:"current_player"`
+	TurnOrder     []string               `json:"turn_order"` // ids of the players still in, in turn order
+	Eliminated    []ClientPlayerIdentity `json:"eliminated_players"`
+	TurnNumber    int                    `json:"turn_number"`
+}
+
+func (m StateSnapshotMessage) isServerMessage() {}
+
 // CREATING NEW MESSAGES
 
-func newRoomCreatedMessage(code string) RoomCreatedMessage {
-	return RoomCreatedMessage{ServerRoomCreated, code}
+func newRoomCreatedMessage(code string, token string) RoomCreatedMessage {
+	return RoomCreatedMessage{ServerRoomCreated, code, token}
+}
+
+func newRoomJoinedMessage(code string, token string) RoomJoinedMessage {
+	return RoomJoinedMessage{ServerRoomJoined, code, token}
+}
+
+func newSpectatingMessage(code string, token string) SpectatingMessage {
+	return SpectatingMessage{ServerSpectating, code, token}
+}
+
+func newLobbyListMessage(lobbies []LobbyInfo) LobbyListMessage {
+	return LobbyListMessage{ServerLobbyList, lobbies}
+}
+
+func newLoggedInMessage(profile Profile, guestToken string) LoggedInMessage {
+	return LoggedInMessage{ServerLoggedIn, profile, guestToken}
 }
 
-func newRoomJoinedMessage() RoomJoinedMessage {
-	return RoomJoinedMessage{ServerRoomJoined}
+func newLoginFailedMessage(reason string) LoginFailedMessage {
+	return LoginFailedMessage{ServerLoginFailed, reason}
+}
+
+func newQueuedMessage() QueuedMessage {
+	return QueuedMessage{ServerQueued}
+}
+
+func newLeftQueueMessage() LeftQueueMessage {
+	return LeftQueueMessage{ServerLeftQueue}
+}
+
+func newReadyCheckMessage(players int, countdown time.Duration) ReadyCheckMessage {
+	return ReadyCheckMessage{ServerReadyCheck, players, int(countdown.Seconds())}
+}
+
+func newReadyCheckFailedMessage(reason string, requeued bool) ReadyCheckFailedMessage {
+	return ReadyCheckFailedMessage{ServerReadyCheckFail, reason, requeued}
 }
 
 func newInvalidCodeMessage() InvalidCodeMessage {
 	return InvalidCodeMessage{ServerInvalidCode}
 }
 
+func newJoinRejectedMessage(reason string) JoinRejectedMessage {
+	return JoinRejectedMessage{ServerJoinRejected, reason}
+}
+
+func newActionRejectedMessage(reason string) ActionRejectedMessage {
+	return ActionRejectedMessage{ServerActionRejected, reason}
+}
+
+func newShotTrajectoryMessage(trajectory ShotTrajectory) ShotTrajectoryMessage {
+	frames := make([][]float64, 0, len(trajectory.frames))
+	for _, frame := range trajectory.frames {
+		flat := make([]float64, 0, 2*len(frame))
+		for _, position := range frame {
+			// a tenth of a world unit is plenty for drawing and keeps the message small
+			flat = append(flat, math.Round(position.X*10)/10, math.Round(position.Y*10)/10)
+		}
+		frames = append(frames, flat)
+	}
+	return ShotTrajectoryMessage{ServerShotTrajectory, trajectory.shooter, trajectory.ids, tools.STEPS_PER_SECOND, trajectory.stepInterval, frames}
+}
+
 func newMakeOwnerMessage() MakeOwnerMessage {
 	return MakeOwnerMessage{ServerMakeOwner}
 }
 
-func newGameStartMessage(currentMap tools.MapState, nextMap tools.MapState, player PlayerIdentity, otherPlayers []PlayerIdentity) GameStartMessage {
-	return GameStartMessage{ServerGameStart, currentMap, nextMap, FormatPlayerId(player), FormatPlayerIds(otherPlayers)}
+func newGameStartMessage(currentMap tools.MapState, nextMap tools.MapState, player PlayerIdentity, otherPlayers []PlayerIdentity, seed string) GameStartMessage {
+	return GameStartMessage{ServerGameStart, currentMap, nextMap, FormatPlayerId(player), FormatPlayerIds(otherPlayers), seed}
 }
 
 func newTurnStartMessage(playerID string) TurnStartMessage {
 	return TurnStartMessage{ServerTurnStart, playerID}
 }
 
-func newTurnTimeoutMessage() TurnTimeoutMessage {
-	return TurnTimeoutMessage{ServerTurnTimeout}
+func newTurnTimeoutMessage(playerID string) TurnTimeoutMessage {
+	return TurnTimeoutMessage{ServerTurnTimeout, playerID}
 }
 
 func newBroadcastTurnMessage(player PlayerIdentity, action PlayerAction) BroadcastTurnMessage {
@@ -171,8 +388,8 @@ func newEntityUpdateMessage(player PlayerIdentity, allPlayers []PlayerIdentity,
 	return EntityUpdateMessage{ServerEntityUpdate, FormatPlayerId(player), FormatPlayerIds(allPlayers), walls}
 }
 
-func newEliminationMessage(elims []PlayerIdentity) EliminationMessage {
-	return EliminationMessage{ServerEliminations, FormatPlayerIds(elims)}
+func newEliminationMessage(elims []PlayerIdentity, turnNumber int) EliminationMessage {
+	return EliminationMessage{ServerEliminations, FormatPlayerIds(elims), turnNumber}
 }
 
 func newWallUpdateMessage(walls []WallState) WallUpdateMessage {
@@ -183,8 +400,8 @@ func newMapUpdateMessage(currentMap tools.MapState, nextMap tools.MapState) MapU
 	return MapUpdateMessage{ServerMapUpdate, currentMap, nextMap}
 }
 
-func newGameFinishedMessage(result string, winnerName string) GameFinishedMessage {
-	return GameFinishedMessage{ServerGameFinished, result, winnerName}
+func newGameFinishedMessage(result string, winnerName string, kills map[string]int, standings []Standing) GameFinishedMessage {
+	return GameFinishedMessage{ServerGameFinished, result, winnerName, kills, standings}
 }
 
 func newLobbyClosedMessage() LobbyClosedMessage {
@@ -195,6 +412,26 @@ func newReturnToLobbyMessage() ReturnToLobbyMessage {
 	return ReturnToLobbyMessage{ServerReturnToLobby}
 }
 
+func newServerShuttingDownMessage(countdown time.Duration) ServerShuttingDownMessage {
+	return ServerShuttingDownMessage{ServerShuttingDown, int(countdown.Seconds())}
+}
+
+func newSessionResumedMessage(playerID string, code string) SessionResumedMessage {
+	return SessionResumedMessage{ServerResumed, playerID, code}
+}
+
+func newSessionTokenMessage(token string) SessionTokenMessage {
+	return SessionTokenMessage{ServerSessionToken, token}
+}
+
+func newResumeFailedMessage() ResumeFailedMessage {
+	return ResumeFailedMessage{ServerResumeFailed}
+}
+
+func newStateSnapshotMessage(code string, inGame bool, currentMap tools.MapState, nextMap tools.MapState, allPlayers []PlayerIdentity, walls []WallState, currentPlayerID string, turnOrder []string, eliminated []PlayerIdentity, turnNumber int) StateSnapshotMessage {
+	return StateSnapshotMessage{ServerStateSnapshot, code, inGame, currentMap, nextMap, FormatPlayerIds(allPlayers), walls, currentPlayerID, turnOrder, FormatPlayerIds(eliminated), turnNumber}
+}
+
 type ClientMessageType string
 
 const (
@@ -208,13 +445,37 @@ const (
 	ClientSimulationDone   ClientMessageType = "simulation-done"
 	ClientReturnToMainMenu ClientMessageType = "return-to-mainmenu"
 	ClientReturnToLobby    ClientMessageType = "return-to-lobby"
+	ClientResume           ClientMessageType = "resume"
+	ClientRequestResync    ClientMessageType = "request-resync"
+	ClientJoinAsSpectator  ClientMessageType = "join-as-spectator"
+	ClientListLobbies      ClientMessageType = "list-lobbies"
+	ClientQuickPlay        ClientMessageType = "quick-play"
+	ClientReplayPlay       ClientMessageType = "replay-play"
+	ClientReplayPause      ClientMessageType = "replay-pause"
+	ClientReplayStep       ClientMessageType = "replay-step"
+	ClientReplaySeek       ClientMessageType = "replay-seek"
+	ClientReplaySpeed      ClientMessageType = "replay-speed"
+	ClientJoinQueue        ClientMessageType = "join-queue"
+	ClientLeaveQueue       ClientMessageType = "leave-queue"
+	ClientReadyAccept      ClientMessageType = "ready-accept"
+	ClientReadyDecline     ClientMessageType = "ready-decline"
+	ClientRegister         ClientMessageType = "register"
+	ClientLogin            ClientMessageType = "login"
+	ClientGuestLogin       ClientMessageType = "guest-login"
 )
 
 type ClientMessage struct {
-	Type     ClientMessageType `json:"type"`
-	Id       string            `json:"id"`
-	Username string            `json:"username"`
-	JoinData PlayerJoinData    `json:"data"`
-	Wall     WallState         `json:"wall_state"`
-	Action   PlayerAction      `json:"player_action"`
+	Type       ClientMessageType `json:"type"`
+	Id         string            `json:"id"`
+	Username   string            `json:"username"`
+	TurnTimer  int               `json:"turn_timer"` //seconds, only read on create-room
+	Visibility string            `json:"visibility"` //"public" or "private" (the default), only read on create-room
+	Token      string            `json:"token"`      //session token on resume, guest token on guest-login
+	Password   string            `json:"password"`   //only read on register and login
+	Seed       string            `json:"seed"`       //match seed, only read on start-game
+	Turn       int               `json:"turn"`       //only read on replay-seek
+	Speed      float64           `json:"speed"`      //playback speed, 1 is real time, only read on replay-speed
+	JoinData   PlayerJoinData    `json:"data"`
+	Wall       WallState         `json:"wall_state"`
+	Action     PlayerAction      `json:"player_action"`
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Metrics holds the server's load numbers and serves them at /metrics in the
+// Prometheus text format. Hub, lobby and player goroutines all write to it, so
+// every field sits behind mu.
+type Metrics struct {
+	mu            sync.Mutex
+	connections   int
+	playerStates  map[string]int // PlayerState name -> players in it
+	lobbyStates   map[string]int // LobbyState name -> lobbies in it
+	gamesStarted  int
+	gamesFinished map[string]int // "win" or "draw"
+	writeFailures map[string]int // why WriteToClient or the write pump failed
+	matchQueue    int            // players waiting in the matchmaking queue
+	turnDuration  *Histogram
+	physicsSteps  *Histogram
+	physicsTime   *Histogram
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		playerStates:  make(map[string]int),
+		lobbyStates:   make(map[string]int),
+		gamesFinished: map[string]int{"win": 0, "draw": 0},
+		writeFailures: map[string]int{"closed": 0, "queue_full": 0, "write_error": 0},
+		turnDuration:  NewHistogram(1, 2, 5, 10, 20, 30, 60, 120),
+		physicsSteps:  NewHistogram(30, 60, 120, 240, 480, 960, 1920),
+		physicsTime:   NewHistogram(0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1),
+	}
+	// every state shows up from the start, even at zero
+	for _, state := range []PlayerState{&PlayerInHub{}, &PlayerRequestedForLobby{}, &PlayerInLobby{}, &PlayerInGame{}, &PlayerGameOver{}, &PlayerSpectating{}, &PlayerInQueue{}} {
+		m.playerStates[stateName(state)] = 0
+	}
+	for _, state := range []LobbyState{LobbyWaitingForPlayers{}, LobbyInTurn{}, LobbyProcessingTurn{}, LobbyGameOver{}} {
+		m.lobbyStates[stateName(state)] = 0
+	}
+	return m
+}
+
+func (m *Metrics) ConnectionOpened() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections++
+}
+
+func (m *Metrics) ConnectionClosed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections--
+}
+
+// PlayerStateChanged moves one player from the from gauge to the to gauge. A
+// nil from is a new player, a nil to is one that has gone.
+func (m *Metrics) PlayerStateChanged(from, to PlayerState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if from != nil {
+		m.playerStates[stateName(from)]--
+	}
+	if to != nil {
+		m.playerStates[stateName(to)]++
+	}
+}
+
+// LobbyStateChanged is PlayerStateChanged for lobbies.
+func (m *Metrics) LobbyStateChanged(from, to LobbyState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if from != nil {
+		m.lobbyStates[stateName(from)]--
+	}
+	if to != nil {
+		m.lobbyStates[stateName(to)]++
+	}
+}
+
+func (m *Metrics) GameStarted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gamesStarted++
+}
+
+func (m *Metrics) GameFinished(result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gamesFinished[result]++
+}
+
+func (m *Metrics) TurnEnded(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.turnDuration.Observe(d.Seconds())
+}
+
+func (m *Metrics) ShotResolved(steps int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.physicsSteps.Observe(float64(steps))
+	m.physicsTime.Observe(d.Seconds())
+}
+
+func (m *Metrics) MatchQueueChanged(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.matchQueue = size
+}
+
+func (m *Metrics) WriteFailed(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writeFailures[reason]++
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteText(w)
+}
+
+// WriteText writes every metric in the Prometheus text exposition format.
+func (m *Metrics) WriteText(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "killiards_connections", "gauge", "Open websocket connections.")
+	fmt.Fprintf(w, "killiards_connections %d\n", m.connections)
+	writeLabeled(w, "killiards_players", "gauge", "Players by state.", "state", m.playerStates)
+	writeLabeled(w, "killiards_lobbies", "gauge", "Open lobbies by state.", "state", m.lobbyStates)
+	writeHeader(w, "killiards_games_started_total", "counter", "Games started.")
+	fmt.Fprintf(w, "killiards_games_started_total %d\n", m.gamesStarted)
+	writeLabeled(w, "killiards_games_finished_total", "counter", "Games finished, by result.", "result", m.gamesFinished)
+	m.turnDuration.WriteText(w, "killiards_turn_duration_seconds", "Time from a turn starting to the shot or timeout.")
+	m.physicsSteps.WriteText(w, "killiards_physics_steps", "Steps PhysicsResolver took to settle a shot.")
+	m.physicsTime.WriteText(w, "killiards_physics_duration_seconds", "Wall time PhysicsResolver took to settle a shot.")
+	writeHeader(w, "killiards_match_queue", "gauge", "Players waiting in the matchmaking queue.")
+	fmt.Fprintf(w, "killiards_match_queue %d\n", m.matchQueue)
+	writeLabeled(w, "killiards_write_failures_total", "counter", "Messages that never reached a client, by reason.", "reason", m.writeFailures)
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeLabeled(w io.Writer, name, kind, help, label string, values map[string]int) {
+	writeHeader(w, name, kind, help)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, values[k])
+	}
+}
+
+// Histogram counts observations into cumulative buckets the way Prometheus
+// expects. It has no lock of its own, Metrics guards it.
+type Histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewHistogram(bounds ...float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) WriteText(w io.Writer, name, help string) {
+	writeHeader(w, name, "histogram", help)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
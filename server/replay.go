@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/Tacoman44444/killiardsgame/server/tools"
+)
+
+// REPLAY_FORMAT_VERSION goes up whenever a replay file changes in a way older
+// readers can't follow.
+const REPLAY_FORMAT_VERSION = 1
+
+// A replay file is JSON lines: a ReplayHeader, then one ReplayEvent per line
+// in the order things happened during the match.
+type ReplayHeader struct {
+	Version    int                    `json:"version"`
+	ID         string                 `json:"id"`
+	Lobby      string                 `json:"lobby"`
+	Seed       string                 `json:"seed"`
+	StartedAt  time.Time              `json:"started_at"`
+	TurnTimer  int                    `json:"turn_timer"` // seconds
+	Players    []ClientPlayerIdentity `json:"players"`    // in seat order, at their spawns
+	CurrentMap tools.MapState         `json:"current_map"`
+	NextMap    tools.MapState         `json:"next_map"`
+}
+
+type ReplayEventType string
+
+const (
+	ReplayTurnStart     ReplayEventType = "turn-start"
+	ReplayTurnTimeout   ReplayEventType = "turn-timeout"
+	ReplayShot          ReplayEventType = "shot"
+	ReplayWall          ReplayEventType = "wall"
+	ReplayWallsTicked   ReplayEventType = "walls-ticked"
+	ReplayShrink        ReplayEventType = "shrink"         // a smaller next map was picked
+	ReplayShrinkApplied ReplayEventType = "shrink-applied" // the next map became the arena
+	ReplayEliminations  ReplayEventType = "eliminations"
+	ReplayForfeit       ReplayEventType = "forfeit"
+	ReplayGameOver      ReplayEventType = "game-over"
+)
+
+// ReplayEvent is one line of a replay after the header. Which fields are set
+// depends on Type.
+type ReplayEvent struct {
+	Type       ReplayEventType        `json:"type"`
+	Turn       int                    `json:"turn"`
+	Player     string                 `json:"player,omitempty"` // who acted, or the winner on game-over
+	Action     *PlayerAction          `json:"action,omitempty"`
+	Wall       *WallState             `json:"wall,omitempty"`
+	Players    []ClientPlayerIdentity `json:"players,omitempty"` // every puck once a shot settled, in seat order
+	Eliminated []ReplayElimination    `json:"eliminated,omitempty"`
+	Result     string                 `json:"result,omitempty"`
+	Kills      map[string]int         `json:"kills,omitempty"`
+}
+
+type ReplayElimination struct {
+	Player   string `json:"player"`
+	KilledBy string `json:"killed_by,omitempty"`
+}
+
+// ReplayRecorder collects a match as it is played. The lobby owns it, so it
+// needs no locking.
+type ReplayRecorder struct {
+	header ReplayHeader
+	events []ReplayEvent
+}
+
+func NewReplayRecorder(lobbyCode string, game *GameState, startedAt time.Time) *ReplayRecorder {
+	return &ReplayRecorder{
+		header: ReplayHeader{
+			Version:    REPLAY_FORMAT_VERSION,
+			ID:         fmt.Sprintf("%s-%s", startedAt.UTC().Format("20060102T150405"), lobbyCode),
+			Lobby:      lobbyCode,
+			Seed:       game.seed,
+			StartedAt:  startedAt,
+			TurnTimer:  int(game.turnTimer.Seconds()),
+			Players:    FormatPlayerIds(PlayerMapToSlice(game.players)),
+			CurrentMap: *game.mapState,
+			NextMap:    *game.nextMap,
+		},
+	}
+}
+
+func (r *ReplayRecorder) ID() string {
+	return r.header.ID
+}
+
+func (r *ReplayRecorder) Record(event ReplayEvent) {
+	r.events = append(r.events, event)
+}
+
+// Replay hands back what has been recorded so far.
+func (r *ReplayRecorder) Replay() *Replay {
+	return &Replay{Header: r.header, Events: slices.Clone(r.events)}
+}
+
+// Replay is a recorded match, as read back from a replay file.
+type Replay struct {
+	Header ReplayHeader
+	Events []ReplayEvent
+}
+
+func (r *Replay) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(r.Header); err != nil {
+		return err
+	}
+	for _, event := range r.Events {
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save writes the replay to <dir>/<id>.jsonl and returns the path.
+func (r *Replay) Save(dir string) (string, error) {
+	path := filepath.Join(dir, r.Header.ID+".jsonl")
+	return path, WriteFileAtomic(path, r.Write)
+}
+
+// WriteFileAtomic writes path through a temp file in the same directory, so
+// a reader never sees half of it.
+func WriteFileAtomic(path string, write func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	if err := write(w); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func ReadReplay(rd io.Reader) (*Replay, error) {
+	dec := json.NewDecoder(rd)
+	replay := &Replay{}
+	if err := dec.Decode(&replay.Header); err != nil {
+		return nil, fmt.Errorf("replay header: %w", err)
+	}
+	if replay.Header.Version != REPLAY_FORMAT_VERSION {
+		return nil, fmt.Errorf("replay format version %d, this server reads %d", replay.Header.Version, REPLAY_FORMAT_VERSION)
+	}
+	for {
+		event := ReplayEvent{}
+		err := dec.Decode(&event)
+		if errors.Is(err, io.EOF) {
+			return replay, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("replay event %d: %w", len(replay.Events)+1, err)
+		}
+		replay.Events = append(replay.Events, event)
+	}
+}
+
+func LoadReplay(path string) (*Replay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadReplay(bufio.NewReader(f))
+}
+
+// Verify plays the whole match again from the seed and the recorded actions
+// and returns the first place it comes out differently, or nil if it matches.
+func (r *Replay) Verify() error {
+	sim, err := NewReplaySimulation(r.Header)
+	if err != nil {
+		return err
+	}
+	for _, event := range r.Events {
+		if err := sim.Apply(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplaySimulation rebuilds a match's GameState one replay event at a time.
+type ReplaySimulation struct {
+	game      *GameState
+	options   tools.ResolverOptions
+	lastShot  tools.ShotResult
+	shotOrder []*PlayerIdentity // the identities in the order the last shot saw them
+}
+
+func NewReplaySimulation(header ReplayHeader) (*ReplaySimulation, error) {
+	if len(header.Players) == 0 {
+		return nil, errors.New("replay has no players")
+	}
+	ids := make([]string, 0, len(header.Players))
+	usernames := make([]string, 0, len(header.Players))
+	for _, p := range header.Players {
+		ids = append(ids, p.Id)
+		usernames = append(usernames, p.Username)
+	}
+	game := GetNewGame(ids, usernames, time.Duration(header.TurnTimer)*time.Second, header.Seed)
+	if !slices.EqualFunc(game.mapState.Arena, header.CurrentMap.Arena, slices.Equal) {
+		return nil, errors.New("the seed gives a different arena")
+	}
+	if err := comparePositions(FormatPlayerIds(PlayerMapToSlice(game.players)), header.Players); err != nil {
+		return nil, fmt.Errorf("spawns: %w", err)
+	}
+	return &ReplaySimulation{game: game}, nil
+}
+
+// Apply plays one event onto the game and checks it against what was recorded.
+func (s *ReplaySimulation) Apply(event ReplayEvent) error {
+	g := s.game
+	player, ok := g.players[event.Player]
+	switch event.Type {
+	case ReplayTurnStart:
+		if !ok {
+			return fmt.Errorf("turn %d: unknown player %q", event.Turn, event.Player)
+		}
+		player.turnsPlayed++
+		g.lastShot = ShotRecord{}
+	case ReplayShot:
+		if !ok || event.Action == nil {
+			return fmt.Errorf("turn %d: shot without a player or action", event.Turn)
+		}
+		s.shotOrder = PlayerMapToSliceRef(g.players)
+		s.lastShot = tools.PhysicsResolver(player.circle, IdentitiesToCircles(s.shotOrder), GetWallRectRefs(g.walls), PlayerActionToShotData(*event.Action), s.options)
+		g.RecordShot(player.id, s.shotOrder, s.lastShot)
+		if err := comparePositions(FormatPlayerIds(PlayerMapToSlice(g.players)), event.Players); err != nil {
+			return fmt.Errorf("turn %d: %w", event.Turn, err)
+		}
+	case ReplayWall:
+		if event.Wall == nil {
+			return fmt.Errorf("turn %d: wall event without a wall", event.Turn)
+		}
+		if reason := g.PlaceWall(NewWallState(event.Wall.PositionX, event.Wall.PositionY, event.Wall.Owner)); reason != "" {
+			return fmt.Errorf("turn %d: wall turned down: %s", event.Turn, reason)
+		}
+	case ReplayWallsTicked:
+		g.TickWalls()
+	case ReplayShrink:
+		nextMap := tools.ShrinkArena(g.nextMap, g.rng)
+		g.mapState = g.nextMap
+		g.nextMap = nextMap
+	case ReplayShrinkApplied:
+		g.mapState = g.nextMap
+	case ReplayEliminations:
+		for _, e := range event.Eliminated {
+			victim, ok := g.players[e.Player]
+			if !ok {
+				return fmt.Errorf("turn %d: unknown player %q", event.Turn, e.Player)
+			}
+			if !tools.IsPlayerEliminated(g.mapState, victim.circle.Center) {
+				return fmt.Errorf("turn %d: %s was eliminated but is still on the arena", event.Turn, e.Player)
+			}
+			victim.alive = false
+			victim.eliminatedOn = event.Turn
+			if killer := g.CreditKill(victim); killer != e.KilledBy {
+				return fmt.Errorf("turn %d: %s was knocked out by %q, recorded %q", event.Turn, e.Player, killer, e.KilledBy)
+			}
+		}
+	case ReplayForfeit:
+		if !ok {
+			return fmt.Errorf("turn %d: unknown player %q", event.Turn, event.Player)
+		}
+		player.alive = false
+		player.eliminatedOn = event.Turn
+	case ReplayGameOver:
+		alive := make([]string, 0, 1)
+		for _, p := range PlayerMapToSliceRef(g.players) {
+			if p.alive {
+				alive = append(alive, p.id)
+			}
+		}
+		if event.Result == "draw" && len(alive) != 0 || event.Result == "win" && !slices.Equal(alive, []string{event.Player}) {
+			return fmt.Errorf("game over: recorded %s for %q, still alive %v", event.Result, event.Player, alive)
+		}
+		if !maps.Equal(g.kills, event.Kills) {
+			return fmt.Errorf("game over: kills %v, recorded %v", g.kills, event.Kills)
+		}
+	case ReplayTurnTimeout:
+	default:
+		return fmt.Errorf("turn %d: unknown replay event %q", event.Turn, event.Type)
+	}
+	return nil
+}
+
+// comparePositions checks two lists of pucks sit in exactly the same spots.
+func comparePositions(got, want []ClientPlayerIdentity) error {
+	if len(got) != len(want) {
+		return fmt.Errorf("%d pucks, recorded %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i].Id != want[i].Id || got[i].PositionX != want[i].PositionX || got[i].PositionY != want[i].PositionY {
+			return fmt.Errorf("puck %s at (%v, %v), recorded %s at (%v, %v)", got[i].Id, got[i].PositionX, got[i].PositionY, want[i].Id, want[i].PositionX, want[i].PositionY)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tacoman44444/killiardsgame/server/tools"
+)
+
+// scriptedReplay plays a few shots the way a lobby does and records them.
+func scriptedReplay(t *testing.T) *Replay {
+	t.Helper()
+	game := GetNewGame([]string{"a", "b", "c"}, []string{"ann", "bob", "cat"}, 30*time.Second, "replay-test")
+	recorder := NewReplayRecorder("ABCD", game, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	actions := []PlayerAction{
+		{Power: 500, DirectionHorizontal: 1, DirectionVertical: 0},
+		{Power: 900, DirectionHorizontal: -0.6, DirectionVertical: 0.8},
+		{Power: 200, DirectionHorizontal: 0, DirectionVertical: -1},
+		{Power: 1200, DirectionHorizontal: 0.7, DirectionVertical: 0.7},
+	}
+	order := []string{"a", "b", "c"}
+	for i, action := range actions {
+		turn := i + 1
+		id := order[i%len(order)]
+		game.players[id].turnsPlayed++
+		recorder.Record(ReplayEvent{Type: ReplayTurnStart, Turn: turn, Player: id})
+		identities := PlayerMapToSliceRef(game.players)
+		shot := tools.PhysicsResolver(game.players[id].circle, IdentitiesToCircles(identities), GetWallRectRefs(game.walls), PlayerActionToShotData(action), tools.ResolverOptions{})
+		game.RecordShot(id, identities, shot)
+		recorder.Record(ReplayEvent{Type: ReplayShot, Turn: turn, Player: id, Action: &action, Players: FormatPlayerIds(PlayerMapToSlice(game.players))})
+	}
+
+	var buf bytes.Buffer
+	if err := recorder.Replay().Write(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	replay, err := ReadReplay(&buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return replay
+}
+
+func TestReplayVerify(t *testing.T) {
+	replay := scriptedReplay(t)
+	if len(replay.Events) != 8 {
+		t.Fatalf("read back %d events, want 8", len(replay.Events))
+	}
+	if err := replay.Verify(); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+}
+
+func TestReplayVerifyTampered(t *testing.T) {
+	replay := scriptedReplay(t)
+	for i, event := range replay.Events {
+		if event.Type == ReplayShot && event.Turn == 3 {
+			replay.Events[i].Players[0].PositionX += 10
+		}
+	}
+	err := replay.Verify()
+	if err == nil {
+		t.Fatal("verify passed a tampered replay")
+	}
+	if !strings.HasPrefix(err.Error(), "turn 3:") {
+		t.Fatalf("verify reported %q, want it to name turn 3", err)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	REPLAY_EVENT_GAP_IN_MILLISECONDS = 500 // pause after anything but a shot, at normal speed
+	MIN_REPLAY_SPEED                 = 0.25
+	MAX_REPLAY_SPEED                 = 16.0
+)
+
+// replayStep is what a live client would have been sent for one replay event
+// and how long to wait before the next one at normal speed. Steps that start a
+// turn also carry a snapshot of the board, which is what seeking sends.
+type replayStep struct {
+	turn     int
+	messages []ServerMessage
+	wait     time.Duration
+	snapshot *StateSnapshotMessage
+}
+
+// ReplayPlayback is a replay turned into the server messages of the live game.
+// Building it re-simulates the match, so a replay that doesn't verify can't be
+// played back.
+type ReplayPlayback struct {
+	start GameStartMessage
+	steps []replayStep
+}
+
+func NewReplayPlayback(replay *Replay, trajectoryEvery int) (*ReplayPlayback, error) {
+	sim, err := NewReplaySimulation(replay.Header)
+	if err != nil {
+		return nil, err
+	}
+	sim.options.RecordEvery = trajectoryEvery
+	g := sim.game
+	seats := PlayerMapToSlice(g.players)
+	playback := &ReplayPlayback{
+		// spectators have no puck of their own, they watch from the first seat
+		start: newGameStartMessage(*g.mapState, *g.nextMap, seats[0], seats[1:], replay.Header.Seed),
+	}
+	gap := REPLAY_EVENT_GAP_IN_MILLISECONDS * time.Millisecond
+	for _, event := range replay.Events {
+		var shooter PlayerIdentity
+		if player, ok := g.players[event.Player]; ok {
+			shooter = *player
+		}
+		if err := sim.Apply(event); err != nil {
+			return nil, err
+		}
+		step := replayStep{turn: event.Turn, wait: gap}
+		switch event.Type {
+		case ReplayTurnStart:
+			snapshot := sim.Snapshot(replay.Header.Lobby, event.Player, event.Turn)
+			step.snapshot = &snapshot
+			step.messages = append(step.messages, newTurnStartMessage(event.Player))
+		case ReplayTurnTimeout:
+			step.messages = append(step.messages, newTurnTimeoutMessage(event.Player))
+		case ReplayShot:
+			step.messages = append(step.messages, newBroadcastTurnMessage(shooter, *event.Action))
+			if trajectoryEvery > 0 {
+				step.messages = append(step.messages, newShotTrajectoryMessage(NewShotTrajectory(event.Player, sim.shotOrder, trajectoryEvery, sim.lastShot)))
+			}
+			step.messages = append(step.messages, newEntityUpdateMessage(*g.players[event.Player], sim.AlivePlayers(), WallStateRefToWallState(g.walls)))
+			step.wait = SimulationSettleTime(sim.lastShot.Steps)
+		case ReplayWall:
+			step.messages = append(step.messages, newWallUpdateMessage(WallStateRefToWallState(g.walls)))
+		case ReplayWallsTicked:
+			step.messages = append(step.messages, newWallUpdateMessage(WallStateRefToWallState(g.walls)))
+			step.wait = 0
+		case ReplayShrink, ReplayShrinkApplied:
+			step.messages = append(step.messages, newMapUpdateMessage(*g.mapState, *g.nextMap))
+		case ReplayEliminations:
+			eliminated := make([]PlayerIdentity, 0, len(event.Eliminated))
+			for _, e := range event.Eliminated {
+				eliminated = append(eliminated, *g.players[e.Player])
+			}
+			step.messages = append(step.messages, newEliminationMessage(eliminated, event.Turn))
+		case ReplayForfeit:
+			step.messages = append(step.messages, newEliminationMessage([]PlayerIdentity{*g.players[event.Player]}, event.Turn))
+		case ReplayGameOver:
+			winnerName := ""
+			if winner, ok := g.players[event.Player]; ok {
+				winnerName = winner.username
+			}
+			step.messages = append(step.messages, newGameFinishedMessage(event.Result, winnerName, event.Kills, g.Standings()))
+		}
+		playback.steps = append(playback.steps, step)
+	}
+	return playback, nil
+}
+
+// SeekIndex finds the step that starts the given turn, or the first turn after
+// it that was played. It reports false when there is no such turn.
+func (p *ReplayPlayback) SeekIndex(turn int) (int, bool) {
+	for i, step := range p.steps {
+		if step.snapshot != nil && step.turn >= turn {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// AlivePlayers lists the pucks still in the match, in seat order.
+func (s *ReplaySimulation) AlivePlayers() []PlayerIdentity {
+	alive := make([]PlayerIdentity, 0, len(s.game.players))
+	for _, p := range PlayerMapToSlice(s.game.players) {
+		if p.alive {
+			alive = append(alive, p)
+		}
+	}
+	return alive
+}
+
+// Snapshot describes the board the way SendSnapshot does for a live lobby.
+func (s *ReplaySimulation) Snapshot(lobbyCode string, currentPlayer string, turn int) StateSnapshotMessage {
+	g := s.game
+	turnOrder := make([]string, 0, len(g.players))
+	eliminated := make([]PlayerIdentity, 0, len(g.players))
+	for _, p := range PlayerMapToSlice(g.players) {
+		if p.alive {
+			turnOrder = append(turnOrder, p.id)
+		} else {
+			eliminated = append(eliminated, p)
+		}
+	}
+	return newStateSnapshotMessage(lobbyCode, true, *g.mapState, *g.nextMap, PlayerMapToSlice(g.players), WallStateRefToWallState(g.walls), currentPlayer, turnOrder, eliminated, turn)
+}
+
+// ServeReplay plays a saved match to a spectator socket. The id is the replay
+// file's name without the extension; ?speed= sets the starting speed.
+func (h *Hub) ServeReplay(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if h.config.ReplayDir == "" || id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		http.NotFound(w, r)
+		return
+	}
+	replay, err := LoadReplay(filepath.Join(h.config.ReplayDir, id+".jsonl"))
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.log.Warn("couldn't load a replay", "replay", id, "err", err)
+		http.Error(w, "unreadable replay", http.StatusInternalServerError)
+		return
+	}
+	playback, err := NewReplayPlayback(replay, h.config.TrajectoryEvery)
+	if err != nil {
+		h.log.Warn("replay doesn't play back", "replay", id, "err", err)
+		http.Error(w, "replay doesn't play back", http.StatusInternalServerError)
+		return
+	}
+	speed := 1.0
+	if s := r.URL.Query().Get("speed"); s != "" {
+		if speed, err = strconv.ParseFloat(s, 64); err != nil {
+			http.Error(w, "bad speed", http.StatusBadRequest)
+			return
+		}
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		h.log.Warn("websocket upgrade failed", "err", err, "remote", r.RemoteAddr)
+		return
+	}
+	h.metrics.ConnectionOpened()
+	conn.SetReadLimit(h.config.MaxMessageSize)
+	viewer := &ReplayViewer{
+		conn:     conn,
+		playback: playback,
+		speed:    ClampReplaySpeed(speed),
+		done:     make(chan struct{}),
+		hub:      h,
+		log:      h.log.With("replay", id),
+	}
+	viewer.log.Info("spectator started watching a replay", "remote", r.RemoteAddr)
+	go viewer.Run()
+}
+
+func ClampReplaySpeed(speed float64) float64 {
+	if !(speed >= MIN_REPLAY_SPEED) { // NaN too
+		return MIN_REPLAY_SPEED
+	}
+	if speed > MAX_REPLAY_SPEED {
+		return MAX_REPLAY_SPEED
+	}
+	return speed
+}
+
+// ReplayViewer feeds one spectator a ReplayPlayback. Run is the only goroutine
+// that writes messages to the socket.
+type ReplayViewer struct {
+	conn     *websocket.Conn
+	playback *ReplayPlayback
+	next     int // index of the step to send next
+	speed    float64
+	paused   bool
+	timer    *time.Timer
+	done     chan struct{} // closed when Run returns, so ReadControls never blocks on a viewer that is gone
+	hub      *Hub
+	log      *slog.Logger
+}
+
+func (v *ReplayViewer) Run() {
+	controls := make(chan ClientMessage)
+	stopPings := make(chan struct{})
+	go v.ReadControls(controls)
+	go v.hub.KeepAlive(v.conn, stopPings)
+	defer func() {
+		close(stopPings)
+		close(v.done)
+		v.StopTimer()
+		v.conn.Close()
+		v.log.Info("spectator stopped watching the replay")
+	}()
+
+	if v.Write(v.playback.start) != nil {
+		return
+	}
+	v.Schedule(REPLAY_EVENT_GAP_IN_MILLISECONDS * time.Millisecond)
+	for {
+		select {
+		case cm, ok := <-controls:
+			if !ok {
+				return
+			}
+			if v.HandleControl(cm) != nil {
+				return
+			}
+		case <-v.timerChannel():
+			v.timer = nil
+			if v.SendStep() != nil {
+				return
+			}
+		}
+	}
+}
+
+// HandleControl applies one message from the spectator.
+func (v *ReplayViewer) HandleControl(cm ClientMessage) error {
+	switch cm.Type {
+	case ClientReplayPause:
+		v.paused = true
+		v.StopTimer()
+	case ClientReplayPlay:
+		if v.paused {
+			v.paused = false
+			v.Schedule(0)
+		}
+	case ClientReplayStep:
+		// stepping always leaves the replay paused on the step it sent
+		v.paused = true
+		v.StopTimer()
+		return v.SendStep()
+	case ClientReplaySeek:
+		index, ok := v.playback.SeekIndex(cm.Turn)
+		if !ok {
+			return v.Write(newActionRejectedMessage("no-such-turn"))
+		}
+		v.next = index
+		if err := v.Write(*v.playback.steps[index].snapshot); err != nil {
+			return err
+		}
+		if !v.paused {
+			v.Schedule(0)
+		}
+	case ClientReplaySpeed:
+		v.speed = ClampReplaySpeed(cm.Speed)
+	default:
+		v.log.Debug("ignoring a message a spectator can't send", "type", cm.Type)
+	}
+	return nil
+}
+
+// SendStep sends the next step and, unless paused, arms the timer for the one
+// after it. Past the end it does nothing; the spectator can still seek back.
+func (v *ReplayViewer) SendStep() error {
+	if v.next >= len(v.playback.steps) {
+		return nil
+	}
+	step := v.playback.steps[v.next]
+	v.next++
+	for _, msg := range step.messages {
+		if err := v.Write(msg); err != nil {
+			return err
+		}
+	}
+	if !v.paused {
+		v.Schedule(step.wait)
+	}
+	return nil
+}
+
+// Schedule arms the timer for the next step, wait being the time it would take
+// at normal speed.
+func (v *ReplayViewer) Schedule(wait time.Duration) {
+	v.StopTimer()
+	if v.next < len(v.playback.steps) {
+		v.timer = time.NewTimer(time.Duration(float64(wait) / v.speed))
+	}
+}
+
+func (v *ReplayViewer) StopTimer() {
+	if v.timer != nil {
+		v.timer.Stop()
+		v.timer = nil
+	}
+}
+
+// a nil channel blocks forever, so a disarmed timer never wins the select in Run.
+func (v *ReplayViewer) timerChannel() <-chan time.Time {
+	if v.timer == nil {
+		return nil
+	}
+	return v.timer.C
+}
+
+func (v *ReplayViewer) Write(msg ServerMessage) error {
+	v.conn.SetWriteDeadline(time.Now().Add(v.hub.config.WriteWait()))
+	err := v.conn.WriteJSON(msg)
+	if err != nil {
+		v.log.Debug("write to spectator failed", "err", err)
+		v.hub.metrics.WriteFailed("write_error")
+	}
+	return err
+}
+
+// ReadControls pumps the spectator's messages into out and closes it once the
+// socket is gone.
+func (v *ReplayViewer) ReadControls(out chan ClientMessage) {
+	defer func() {
+		v.conn.Close()
+		v.hub.metrics.ConnectionClosed()
+		close(out)
+	}()
+
+	pongWait := v.hub.config.PongWait()
+	v.conn.SetReadDeadline(time.Now().Add(pongWait))
+	v.conn.SetPongHandler(func(string) error {
+		v.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	for {
+		msg := ClientMessage{}
+		if err := v.conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		v.conn.SetReadDeadline(time.Now().Add(pongWait))
+		select {
+		case out <- msg:
+		case <-v.done:
+			return
+		}
+	}
+}
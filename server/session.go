@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RECONNECT_GRACE_IN_SECONDS = 30
+	SESSION_REFRESH_IN_SECONDS = 10 // how often a player in a lobby gets a fresh token
+	SESSION_SECRET_LENGTH      = 32
+)
+
+// SessionClaims is what a session token vouches for: which player seat it
+// belongs to and the lobby that seat was in when the token was issued.
+type SessionClaims struct {
+	PlayerID  string
+	LobbyCode string
+	IssuedAt  time.Time
+}
+
+// Sessions tracks the players holding a session token. Lobbies start a session
+// when they accept someone, the hub looks them up on resume and ends them when
+// the player goes away for good.
+type Sessions struct {
+	mu      sync.Mutex
+	players map[string]*Player // player id -> player
+}
+
+func NewSessions() *Sessions {
+	return &Sessions{players: make(map[string]*Player)}
+}
+
+func (s *Sessions) Add(player *Player) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.players[player.id] = player
+}
+
+func (s *Sessions) Get(playerID string) (*Player, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	player, ok := s.players[playerID]
+	return player, ok
+}
+
+// End forgets player's session, unless a newer player took the id since.
+func (s *Sessions) End(player *Player) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.players[player.id] == player {
+		delete(s.players, player.id)
+	}
+}
+
+func NewSessionSecret() []byte {
+	secret := make([]byte, SESSION_SECRET_LENGTH)
+	if _, err := rand.Read(secret); err != nil {
+		panic("could not generate a session secret: " + err.Error())
+	}
+	return secret
+}
+
+// SignSessionToken builds a token of the form <payload>.<signature>, both base64
+// encoded, where the payload is "<player id>:<lobby code>:<unix seconds>".
+func SignSessionToken(secret []byte, claims SessionClaims) string {
+	payload := claims.PlayerID + ":" + claims.LobbyCode + ":" + strconv.FormatInt(claims.IssuedAt.Unix(), 10)
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return encoded + "." + sessionSignature(secret, encoded)
+}
+
+// VerifySessionToken checks the signature on a token and returns its claims.
+func VerifySessionToken(secret []byte, token string) (SessionClaims, bool) {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found {
+		return SessionClaims{}, false
+	}
+	if !hmac.Equal([]byte(signature), []byte(sessionSignature(secret, encoded))) {
+		return SessionClaims{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return SessionClaims{}, false
+	}
+	parts := strings.Split(string(payload), ":")
+	if len(parts) != 3 {
+		return SessionClaims{}, false
+	}
+	issuedAt, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return SessionClaims{}, false
+	}
+
+	return SessionClaims{PlayerID: parts[0], LobbyCode: parts[1], IssuedAt: time.Unix(issuedAt, 0)}, true
+}
+
+// SessionExpired reports whether a token is too old to resume with. A player
+// in a lobby is sent a fresh token every SESSION_REFRESH_IN_SECONDS, so the
+// one they hold when the connection drops is never older than that.
+func SessionExpired(claims SessionClaims, now time.Time) bool {
+	return now.Sub(claims.IssuedAt) > (RECONNECT_GRACE_IN_SECONDS+SESSION_REFRESH_IN_SECONDS)*time.Second
+}
+
+func sessionSignature(secret []byte, encodedPayload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(encodedPayload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	STORE_FORMAT_VERSION = 1
+	MAX_USERNAME_LENGTH  = 24
+	MIN_PASSWORD_LENGTH  = 8
+	PASSWORD_ITERATIONS  = 600000
+	PASSWORD_SALT_LENGTH = 16
+	PASSWORD_HASH_LENGTH = 32
+	GUEST_TOKEN_LENGTH   = 32
+	ELO_K_FACTOR         = 32.0
+)
+
+var (
+	ErrUsernameTaken   = errors.New("username-taken")
+	ErrInvalidUsername = errors.New("invalid-username")
+	ErrWeakPassword    = errors.New("weak-password")
+	ErrBadCredentials  = errors.New("bad-credentials")
+	ErrNotFound        = errors.New("not-found")
+)
+
+// Store keeps everything about players that has to outlive a restart. Every
+// method is safe to call from any goroutine.
+type Store interface {
+	// Register creates an account that logs in with a username and password.
+	Register(username, password string) (Profile, error)
+	Login(username, password string) (Profile, error)
+	// CreateGuest creates an account that logs in with the token it returns
+	// instead of a password. Guest usernames don't have to be unique.
+	CreateGuest(username string) (Profile, string, error)
+	GuestLogin(token string) (Profile, error)
+	Profile(id string) (Profile, error)
+	// RecordMatch saves a finished match, fills in each account's rating
+	// before and after it, and updates their ratings and stats.
+	RecordMatch(match MatchRecord) (MatchRecord, error)
+	// Leaderboard ranks every account that has finished a game, by "rating"
+	// or "wins", and returns limit of them starting at offset along with how
+	// many there are in all.
+	Leaderboard(by string, offset, limit int) ([]Profile, int, error)
+	// PlayerMatches pages through an account's matches, newest first.
+	PlayerMatches(accountID string, offset, limit int) ([]MatchRecord, int, error)
+	Match(id string) (MatchRecord, error)
+	Close() error
+}
+
+// Profile is the public side of an account.
+type Profile struct {
+	ID        string      `json:"id"`
+	Username  string      `json:"username"`
+	Guest     bool        `json:"guest"`
+	Rating    float64     `json:"rating"` // Elo
+	Stats     PlayerStats `json:"stats"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+type PlayerStats struct {
+	Games         int `json:"games"`
+	Wins          int `json:"wins"`
+	Knockouts     int `json:"knockouts"`
+	SurvivalTurns int `json:"survival_turns"` // turns taken over every game
+}
+
+// MatchRecord is a finished match as the store keeps it.
+type MatchRecord struct {
+	ID         string        `json:"id"` // the replay id
+	Lobby      string        `json:"lobby"`
+	Seed       string        `json:"seed"`
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt time.Time     `json:"finished_at"`
+	Turns      int           `json:"turns"`
+	Result     string        `json:"result"`           // win or draw
+	Winner     string        `json:"winner,omitempty"` // player id
+	Players    []MatchPlayer `json:"players"`          // best placement first
+}
+
+type MatchPlayer struct {
+	PlayerID     string  `json:"player_id"`
+	AccountID    string  `json:"account_id,omitempty"` // empty for a player who wasn't logged in
+	Username     string  `json:"username"`
+	Placement    int     `json:"placement"` // 1 is the winner
+	Knockouts    int     `json:"knockouts"`
+	Turns        int     `json:"turns"`                   // turns this player took
+	EliminatedOn int     `json:"eliminated_on,omitempty"` // the turn they were knocked out on, 0 if they never were
+	Shots        int     `json:"shots"`
+	Distance     float64 `json:"distance"` // world units their puck travelled
+	RatingBefore float64 `json:"rating_before,omitempty"`
+	RatingAfter  float64 `json:"rating_after,omitempty"`
+}
+
+// storedAccount is a Profile with the secrets that go with it.
+type storedAccount struct {
+	Profile
+	Salt           []byte `json:"salt,omitempty"`
+	PasswordHash   []byte `json:"password_hash,omitempty"`
+	GuestTokenHash []byte `json:"guest_token_hash,omitempty"`
+}
+
+type storeFile struct {
+	Version  int             `json:"version"`
+	Accounts []storedAccount `json:"accounts"`
+}
+
+// FileStore keeps every account and match in memory. Accounts are written to
+// a JSON file after each change, and matches are appended to a JSON lines
+// file next to it (see MatchLogPath). With an empty path nothing is written.
+// Guests are only written once they have finished a match, so a guest-login
+// that never plays doesn't outlive a restart.
+type FileStore struct {
+	mu       sync.Mutex
+	path     string
+	accounts map[string]*storedAccount // id -> account
+	byName   map[string]*storedAccount // lowercased username -> registered account
+	byToken  map[string]*storedAccount // guest token hash -> guest account
+	matches  []MatchRecord             // oldest first
+	matchLog *os.File                  // nil with an empty path
+	seq      int                       // bumped by every change to the accounts
+
+	saveMu sync.Mutex // held while writing the accounts file
+	saved  int        // the seq the accounts file was last written at
+}
+
+// MatchLogPath is where a store at path appends its matches.
+func MatchLogPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + "-matches.jsonl"
+}
+
+// OpenFileStore loads path and its match log if they exist, or starts empty if
+// they don't.
+func OpenFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path:     path,
+		accounts: make(map[string]*storedAccount),
+		byName:   make(map[string]*storedAccount),
+		byToken:  make(map[string]*storedAccount),
+	}
+	if path == "" {
+		return s, nil
+	}
+	if err := s.loadAccounts(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	matchLog, err := os.OpenFile(MatchLogPath(path), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadMatches(matchLog); err != nil {
+		matchLog.Close()
+		return nil, err
+	}
+	s.matchLog = matchLog
+	return s, nil
+}
+
+func (s *FileStore) loadAccounts() error {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data := storeFile{}
+	if err := json.NewDecoder(bufio.NewReader(f)).Decode(&data); err != nil {
+		return err
+	}
+	if data.Version != STORE_FORMAT_VERSION {
+		return errors.New("store file was written by a different version of the server")
+	}
+	for _, account := range data.Accounts {
+		s.index(&account)
+	}
+	return nil
+}
+
+// loadMatches reads every match in the log. A match that was cut off halfway
+// through being written is dropped from the end of the file.
+func (s *FileStore) loadMatches(f *os.File) error {
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		match := MatchRecord{}
+		err := dec.Decode(&match)
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return f.Truncate(dec.InputOffset())
+		}
+		if err != nil {
+			return err
+		}
+		s.matches = append(s.matches, match)
+	}
+}
+
+func (s *FileStore) index(account *storedAccount) {
+	s.accounts[account.ID] = account
+	if account.Guest {
+		s.byToken[string(account.GuestTokenHash)] = account
+	} else {
+		s.byName[strings.ToLower(account.Username)] = account
+	}
+}
+
+func (s *FileStore) Register(username, password string) (Profile, error) {
+	username = strings.TrimSpace(username)
+	if !ValidUsername(username) {
+		return Profile{}, ErrInvalidUsername
+	}
+	if len(password) < MIN_PASSWORD_LENGTH {
+		return Profile{}, ErrWeakPassword
+	}
+	salt := make([]byte, PASSWORD_SALT_LENGTH)
+	if _, err := rand.Read(salt); err != nil {
+		return Profile{}, err
+	}
+	// hashing is slow on purpose, so keep it outside the lock
+	hash, err := hashPassword(password, salt)
+	if err != nil {
+		return Profile{}, err
+	}
+
+	s.mu.Lock()
+	if s.byName[strings.ToLower(username)] != nil {
+		s.mu.Unlock()
+		return Profile{}, ErrUsernameTaken
+	}
+	account := &storedAccount{Profile: newProfile(username, false), Salt: salt, PasswordHash: hash}
+	s.index(account)
+	seq, accounts := s.snapshot()
+	s.mu.Unlock()
+	return account.Profile, s.saveAccounts(seq, accounts)
+}
+
+func (s *FileStore) Login(username, password string) (Profile, error) {
+	s.mu.Lock()
+	account := s.byName[strings.ToLower(strings.TrimSpace(username))]
+	s.mu.Unlock()
+	if account == nil {
+		return Profile{}, ErrBadCredentials
+	}
+	// salt and hash never change once an account exists
+	hash, err := hashPassword(password, account.Salt)
+	if err != nil {
+		return Profile{}, err
+	}
+	if subtle.ConstantTimeCompare(hash, account.PasswordHash) != 1 {
+		return Profile{}, ErrBadCredentials
+	}
+	return s.Profile(account.ID)
+}
+
+func (s *FileStore) CreateGuest(username string) (Profile, string, error) {
+	username = strings.TrimSpace(username)
+	if !ValidUsername(username) {
+		return Profile{}, "", ErrInvalidUsername
+	}
+	raw := make([]byte, GUEST_TOKEN_LENGTH)
+	if _, err := rand.Read(raw); err != nil {
+		return Profile{}, "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account := &storedAccount{Profile: newProfile(username, true), GuestTokenHash: hashGuestToken(token)}
+	// the guest is written out with the first match it finishes
+	s.index(account)
+	return account.Profile, token, nil
+}
+
+func (s *FileStore) GuestLogin(token string) (Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account := s.byToken[string(hashGuestToken(token))]
+	if account == nil {
+		return Profile{}, ErrBadCredentials
+	}
+	return account.Profile, nil
+}
+
+func (s *FileStore) Profile(id string) (Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account := s.accounts[id]
+	if account == nil {
+		return Profile{}, ErrNotFound
+	}
+	return account.Profile, nil
+}
+
+func (s *FileStore) RecordMatch(match MatchRecord) (MatchRecord, error) {
+	s.mu.Lock()
+	match.Players = slices.Clone(match.Players)
+
+	rated := make([]*MatchPlayer, 0, len(match.Players))
+	ratings := make([]float64, 0, len(match.Players))
+	for i := range match.Players {
+		if account := s.accounts[match.Players[i].AccountID]; account != nil {
+			rated = append(rated, &match.Players[i])
+			ratings = append(ratings, account.Rating)
+		}
+	}
+	placements := make([]int, 0, len(rated))
+	for _, p := range rated {
+		placements = append(placements, p.Placement)
+	}
+	changes := EloChanges(ratings, placements)
+	for i, p := range rated {
+		account := s.accounts[p.AccountID]
+		p.RatingBefore = account.Rating
+		p.RatingAfter = account.Rating + changes[i]
+		account.Rating = p.RatingAfter
+		account.Stats.Games++
+		if p.Placement == 1 && match.Result == "win" {
+			account.Stats.Wins++
+		}
+		account.Stats.Knockouts += p.Knockouts
+		account.Stats.SurvivalTurns += p.Turns
+	}
+	s.matches = append(s.matches, match)
+	if err := s.appendMatch(match); err != nil {
+		s.mu.Unlock()
+		return match, err
+	}
+	seq, accounts := s.snapshot()
+	s.mu.Unlock()
+	return match, s.saveAccounts(seq, accounts)
+}
+
+func (s *FileStore) Leaderboard(by string, offset, limit int) ([]Profile, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ranked := make([]Profile, 0, len(s.accounts))
+	for _, account := range s.accounts {
+		if account.Stats.Games > 0 {
+			ranked = append(ranked, account.Profile)
+		}
+	}
+	slices.SortFunc(ranked, func(a, b Profile) int {
+		if by == "wins" {
+			return cmp.Or(cmp.Compare(b.Stats.Wins, a.Stats.Wins), cmp.Compare(b.Rating, a.Rating), cmp.Compare(a.ID, b.ID))
+		}
+		return cmp.Or(cmp.Compare(b.Rating, a.Rating), cmp.Compare(b.Stats.Wins, a.Stats.Wins), cmp.Compare(a.ID, b.ID))
+	})
+	return Page(ranked, offset, limit), len(ranked), nil
+}
+
+func (s *FileStore) PlayerMatches(accountID string, offset, limit int) ([]MatchRecord, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accounts[accountID] == nil {
+		return nil, 0, ErrNotFound
+	}
+	played := make([]MatchRecord, 0)
+	for i := len(s.matches) - 1; i >= 0; i-- {
+		if slices.ContainsFunc(s.matches[i].Players, func(p MatchPlayer) bool { return p.AccountID == accountID }) {
+			played = append(played, s.matches[i])
+		}
+	}
+	return Page(played, offset, limit), len(played), nil
+}
+
+func (s *FileStore) Match(id string) (MatchRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, match := range s.matches {
+		if match.ID == id {
+			return match, nil
+		}
+	}
+	return MatchRecord{}, ErrNotFound
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.matchLog == nil {
+		return nil
+	}
+	err := s.matchLog.Close()
+	s.matchLog = nil
+	return err
+}
+
+// appendMatch adds one line to the match log. The caller holds the lock, so
+// the log stays in the same order as s.matches.
+func (s *FileStore) appendMatch(match MatchRecord) error {
+	if s.matchLog == nil {
+		return nil
+	}
+	return json.NewEncoder(s.matchLog).Encode(match)
+}
+
+// snapshot copies the accounts that get written out, which is every
+// registered account and every guest that has finished a match. The caller
+// holds the lock.
+func (s *FileStore) snapshot() (int, []storedAccount) {
+	s.seq++
+	if s.path == "" {
+		return s.seq, nil
+	}
+	accounts := make([]storedAccount, 0, len(s.accounts))
+	for _, account := range s.accounts {
+		if !account.Guest || account.Stats.Games > 0 {
+			accounts = append(accounts, *account)
+		}
+	}
+	slices.SortFunc(accounts, func(a, b storedAccount) int { return cmp.Compare(a.ID, b.ID) })
+	return s.seq, accounts
+}
+
+// saveAccounts writes a snapshot out without holding the lock. A snapshot
+// older than the one already written is dropped.
+func (s *FileStore) saveAccounts(seq int, accounts []storedAccount) error {
+	if s.path == "" {
+		return nil
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if seq <= s.saved {
+		return nil
+	}
+	data := storeFile{Version: STORE_FORMAT_VERSION, Accounts: accounts}
+	err := WriteFileAtomic(s.path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(data)
+	})
+	if err == nil {
+		s.saved = seq
+	}
+	return err
+}
+
+// Page cuts limit items out of items starting at offset.
+func Page[T any](items []T, offset, limit int) []T {
+	start := min(offset, len(items))
+	end := min(start+limit, len(items))
+	return slices.Clone(items[start:end])
+}
+
+func newProfile(username string, guest bool) Profile {
+	return Profile{
+		ID:        randomAlphanumericString(),
+		Username:  username,
+		Guest:     guest,
+		Rating:    DEFAULT_RATING,
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+func ValidUsername(username string) bool {
+	return username != "" && len(username) <= MAX_USERNAME_LENGTH
+}
+
+func hashPassword(password string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, PASSWORD_ITERATIONS, PASSWORD_HASH_LENGTH)
+}
+
+// guest tokens are long and random, so a plain hash is enough to keep a
+// leaked store file from logging anyone in.
+func hashGuestToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// EloChanges rates a match with any number of players as every pair of them
+// having played each other: the better placement wins, equal placements
+// draw. K is split between the pairs so a big match moves ratings about as
+// much as a duel.
+func EloChanges(ratings []float64, placements []int) []float64 {
+	changes := make([]float64, len(ratings))
+	if len(ratings) < 2 {
+		return changes
+	}
+	k := ELO_K_FACTOR / float64(len(ratings)-1)
+	for i := range ratings {
+		for j := range ratings {
+			if i == j {
+				continue
+			}
+			expected := 1 / (1 + math.Pow(10, (ratings[j]-ratings[i])/400))
+			score := 0.5
+			if placements[i] < placements[j] {
+				score = 1
+			} else if placements[i] > placements[j] {
+				score = 0
+			}
+			changes[i] += k * (score - expected)
+		}
+	}
+	return changes
+}
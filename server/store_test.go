@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	played, playedToken, err := s.CreateGuest("played")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle, idleToken, err := s.CreateGuest("idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("creating guests wrote the store file (stat err %v)", err)
+	}
+	match := MatchRecord{ID: "m1", Result: "win", Winner: "p1", Players: []MatchPlayer{
+		{PlayerID: "p1", AccountID: played.ID, Username: "played", Placement: 1},
+		{PlayerID: "p2", Username: "anon", Placement: 2},
+	}}
+	if _, err := s.RecordMatch(match); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	profile, err := s.GuestLogin(playedToken)
+	if err != nil {
+		t.Fatalf("guest who finished a match can't log in after reopening: %v", err)
+	}
+	if profile.Stats.Games != 1 || profile.Stats.Wins != 1 {
+		t.Errorf("reopened guest has stats %+v, want 1 game and 1 win", profile.Stats)
+	}
+	if _, err := s.GuestLogin(idleToken); err != ErrBadCredentials {
+		t.Errorf("guest who never played logged in after reopening, err %v", err)
+	}
+	if _, err := s.Profile(idle.ID); err != ErrNotFound {
+		t.Errorf("guest who never played was kept, err %v", err)
+	}
+	if got, err := s.Match("m1"); err != nil || got.Winner != "p1" {
+		t.Errorf("match after reopening is %+v, err %v", got, err)
+	}
+
+	// a new match goes on the end of the log
+	match.ID = "m2"
+	if _, err := s.RecordMatch(match); err != nil {
+		t.Fatal(err)
+	}
+	matches, total, err := s.PlayerMatches(played.ID, 0, 10)
+	if err != nil || total != 2 || matches[0].ID != "m2" {
+		t.Errorf("got matches %v (total %d, err %v), want m2 then m1", matches, total, err)
+	}
+}
+
+func TestFileStoreTornMatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RecordMatch(MatchRecord{ID: "m1", Result: "draw"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	f, err := os.OpenFile(MatchLogPath(path), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"m2","res`)
+	f.Close()
+
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("couldn't reopen after a torn write: %v", err)
+	}
+	if _, err := s.RecordMatch(MatchRecord{ID: "m3", Result: "draw"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Match("m3"); err != nil {
+		t.Errorf("match written after the torn one is missing: %v", err)
+	}
+	if _, err := s.Match("m2"); err != ErrNotFound {
+		t.Errorf("torn match was kept, err %v", err)
+	}
+}
@@ -3,8 +3,8 @@ package tools
 import (
 	"fmt"
 	"hash/fnv"
+	"log/slog"
 	"math/rand"
-	"time"
 )
 
 type MapState struct {
@@ -16,9 +16,17 @@ type MapState struct {
 	topLeft       Vector2Int
 }
 
-func ShrinkArena(mapState *MapState) *MapState {
+// NewSeededRand is the single random source for one match. Every random choice
+// about the board takes it, so the same seed always gives the same match.
+func NewSeededRand(seed string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+func ShrinkArena(mapState *MapState, r *rand.Rand) *MapState {
 	if mapState.currentWidth <= 4 || mapState.currentHeight <= 4 {
-		fmt.Println("Map too small to shrink further.")
+		slog.Debug("map too small to shrink further")
 		return mapState
 	}
 
@@ -29,9 +37,6 @@ func ShrinkArena(mapState *MapState) *MapState {
 	maxStartX := mapState.topLeft.X + (mapState.currentWidth - newWidth)
 	maxStartY := mapState.topLeft.Y + (mapState.currentHeight - newHeight)
 
-	// Seed randomness
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-
 	// Pick a random top-left corner for the new chunk
 	startX := r.Intn(maxStartX-mapState.topLeft.X+1) + mapState.topLeft.X
 	startY := r.Intn(maxStartY-mapState.topLeft.Y+1) + mapState.topLeft.Y
@@ -105,25 +110,25 @@ func WorldToTileCoords(worldCoords Vector2) Vector2Int {
 	}
 }
 
-func GenerateSafeSpawns(number int, mapState *MapState) []Vector2 {
+func GenerateSafeSpawns(number int, mapState *MapState, r *rand.Rand) []Vector2 {
 	spawnTiles := make([]Vector2Int, 0, number)
 	for i := 0; i < number; i++ {
-		spawnTiles = append(spawnTiles, GetSafeTile(spawnTiles, mapState))
+		spawnTiles = append(spawnTiles, GetSafeTile(spawnTiles, mapState, r))
 	}
 	spawns := make([]Vector2, 0, number)
 	for i := range spawnTiles {
 		spawns = append(spawns, TileToWorldCoords(spawnTiles[i]))
 	}
-	fmt.Println(spawns)
+	slog.Debug("spawn points picked", "spawns", spawns)
 	return spawns
 }
 
-func GetSafeTile(tiles []Vector2Int, mapState *MapState) Vector2Int {
+func GetSafeTile(tiles []Vector2Int, mapState *MapState, r *rand.Rand) Vector2Int {
 	iteration := 0
 	for {
-		tile := GetWalkableTile(mapState)
+		tile := GetWalkableTile(mapState, r)
 		if iteration > 100 {
-			fmt.Println("GetSafeTile() is not returning a safe tile -- 1/10 ragebait")
+			slog.Warn("GetSafeTile() is not returning a safe tile -- 1/10 ragebait")
 			return tile
 		}
 		if len(tiles) == 0 {
@@ -143,12 +148,11 @@ func GetSafeTile(tiles []Vector2Int, mapState *MapState) Vector2Int {
 	}
 }
 
-func GetWalkableTile(mapState *MapState) Vector2Int {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+func GetWalkableTile(mapState *MapState, r *rand.Rand) Vector2Int {
 	iteration := 0
 	for {
 		if iteration > 100 {
-			fmt.Println("GetWalkableTile() is not returning a walkable tile -- 0/10 ragebait")
+			slog.Warn("GetWalkableTile() is not returning a walkable tile -- 0/10 ragebait")
 			return Vector2Int{-1, -1}
 		}
 		row := r.Intn(mapState.Height)
@@ -173,28 +177,43 @@ func IsPlayerEliminated(mapState *MapState, playerCenter Vector2) bool {
 	}
 }
 
-func GenerateMap(width, height int, useCustomSeed bool, seedString string) *MapState {
-	newArena := RandomFillMap(width, height, useCustomSeed, seedString)
+// IsRectOnArena reports whether every tile the rect covers is inside the map
+// and walkable.
+func IsRectOnArena(mapState *MapState, rect Rect) bool {
+	if rect.TopLeft.X < 0 || rect.TopLeft.Y < 0 || rect.Width <= 0 || rect.Height <= 0 {
+		return false
+	}
+	first := WorldToTileCoords(rect.TopLeft)
+	// the far edges belong to the next tile over, so step back just inside them
+	last := WorldToTileCoords(Vector2{X: rect.TopLeft.X + rect.Width - 1e-6, Y: rect.TopLeft.Y + rect.Height - 1e-6})
+	if last.Y >= len(mapState.Arena) {
+		return false
+	}
+	for y := first.Y; y <= last.Y; y++ {
+		if last.X >= len(mapState.Arena[y]) {
+			return false
+		}
+		for x := first.X; x <= last.X; x++ {
+			if mapState.Arena[y][x] != TILETYPE_WALKABLE {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func GenerateMap(width, height int, r *rand.Rand) *MapState {
+	newArena := RandomFillMap(width, height, r)
 	for i := 0; i < 5; i++ {
 		SmoothMap(newArena)
 	}
 	return newArena
 }
 
-func RandomFillMap(width int, height int, useCustomSeed bool, seedString string) *MapState {
+func RandomFillMap(width int, height int, r *rand.Rand) *MapState {
 	arena := make([][]int, height)
-	for r := range arena {
-		arena[r] = make([]int, width)
-	}
-
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-	if useCustomSeed {
-		h := fnv.New32a()
-		h.Write([]byte(seedString))
-		seed := int64(h.Sum32())
-
-		r = rand.New(rand.NewSource(seed))
+	for row := range arena {
+		arena[row] = make([]int, width)
 	}
 
 	for x := 0; x < height; x++ {
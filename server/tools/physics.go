@@ -1,7 +1,6 @@
 package tools
 
 import (
-	"fmt"
 	"math"
 )
 
@@ -45,9 +44,24 @@ const (
 )
 
 type Rect struct {
-	topleft Vector2
-	width   float64
-	height  float64
+	TopLeft Vector2
+	Width   float64
+	Height  float64
+}
+
+// Overlaps reports whether two rects share any area; touching edges don't count.
+func (r Rect) Overlaps(o Rect) bool {
+	return r.TopLeft.X < o.TopLeft.X+o.Width && o.TopLeft.X < r.TopLeft.X+r.Width &&
+		r.TopLeft.Y < o.TopLeft.Y+o.Height && o.TopLeft.Y < r.TopLeft.Y+r.Height
+}
+
+// OverlapsCircle reports whether the circle reaches into the rect.
+func (r Rect) OverlapsCircle(c Circle) bool {
+	closest := Vector2{
+		X: math.Max(r.TopLeft.X, math.Min(c.Center.X, r.TopLeft.X+r.Width)),
+		Y: math.Max(r.TopLeft.Y, math.Min(c.Center.Y, r.TopLeft.Y+r.Height)),
+	}
+	return c.Center.Subtract(closest).LengthSquared() < c.Radius*c.Radius
 }
 
 type Circle struct {
@@ -61,37 +75,111 @@ func (c *Circle) DistanceSquared(c1 *Circle) float64 {
 }
 
 type ShotData struct {
-	Power     int //should be a value from one to 5, could make this an enum.
+	Power     int //speed for one of the five power levels, see SHOT_POWER_LEVELS in the server package
 	Direction Vector2
 }
 
 const (
-	dt         = 1.0 / 120.0
-	drag       = 0.989
-	stop2      = 0.05
-	settleNeed = 5
-	maxSteps   = 30 * 120
+	STEPS_PER_SECOND = 120
+	dt               = 1.0 / STEPS_PER_SECOND
+	drag             = 0.989
+	stop2            = 0.05
+	settleNeed       = 5
+	maxSteps         = 30 * 120
 )
 
-func PhysicsResolver(activePlayer *Circle, playerPositions []*Circle, walls []*Rect, shotData ShotData) {
+// Contact is one collision between two circles, given as indices into the
+// circles passed to PhysicsResolver.
+type Contact struct {
+	A       int
+	B       int
+	Step    int
+	Impulse float64 // size of the impulse the two circles exchanged
+}
+
+// WallBounce is one circle bouncing off a wall.
+type WallBounce struct {
+	Circle int
+	Wall   int
+	Step   int
+}
+
+// ShotResult is what PhysicsResolver learned while playing a shot out. Both
+// logs are in the order things happened.
+type ShotResult struct {
+	Steps       int
+	Contacts    []Contact
+	WallBounces []WallBounce
+	Frames      [][]Vector2 // every circle's position, see ResolverOptions.RecordEvery
+	Distances   []float64   // how far each circle travelled, in world units
+}
+
+// ResolverOptions tunes what PhysicsResolver records besides the end state.
+type ResolverOptions struct {
+	// RecordEvery samples every circle's position every this many steps, plus
+	// the start and the settled end. 0 records nothing.
+	RecordEvery int
+}
+
+func (r *ShotResult) recordFrame(circles []*Circle) {
+	frame := make([]Vector2, len(circles))
+	for i := range circles {
+		frame[i] = circles[i].Center
+	}
+	r.Frames = append(r.Frames, frame)
+}
+
+// PhysicsResolver plays a shot out until every circle has settled and reports
+// how many steps that took and which circles hit each other.
+func PhysicsResolver(activePlayer *Circle, playerPositions []*Circle, walls []*Rect, shotData ShotData, options ResolverOptions) ShotResult {
 	ApplyImpulse(activePlayer, shotData)
+	result := ShotResult{Distances: make([]float64, len(playerPositions))}
+	last := make([]Vector2, len(playerPositions))
+	for i := range playerPositions {
+		last[i] = playerPositions[i].Center
+	}
+	recording := options.RecordEvery > 0
+	recordedAt := 0 // step the last frame was taken at
+	if recording {
+		result.recordFrame(playerPositions)
+	}
 	slowFrames := 0
-	for step := 0; step < maxSteps; step++ {
+	for ; result.Steps < maxSteps; result.Steps++ {
 		Integrate(playerPositions)
-		ResolveCircleWallCollisions(playerPositions, walls)
-		ResolveCircleCircleCollisions(playerPositions)
+		for _, bounce := range ResolveCircleWallCollisions(playerPositions, walls) {
+			bounce.Step = result.Steps
+			result.WallBounces = append(result.WallBounces, bounce)
+		}
+		for _, contact := range ResolveCircleCircleCollisions(playerPositions) {
+			contact.Step = result.Steps
+			result.Contacts = append(result.Contacts, contact)
+		}
 		ApplyFriction(playerPositions)
+		for i := range playerPositions {
+			result.Distances[i] += playerPositions[i].Center.Subtract(last[i]).Length()
+			last[i] = playerPositions[i].Center
+		}
 
 		if AllStopped(playerPositions) {
 			slowFrames++
 			if slowFrames >= settleNeed {
 				ResetVelocities(playerPositions)
+				result.Steps++
 				break
 			}
 		} else {
 			slowFrames = 0
 		}
+		if recording && (result.Steps+1)%options.RecordEvery == 0 {
+			result.recordFrame(playerPositions)
+			recordedAt = result.Steps + 1
+		}
+	}
+	// the last frame is always where everything came to rest
+	if recording && recordedAt != result.Steps {
+		result.recordFrame(playerPositions)
 	}
+	return result
 }
 
 // HELPER FUNCTIONS
@@ -110,28 +198,31 @@ func CheckCircleCircleCollision(c1 Circle, c2 Circle) bool {
 	return (c1.Center.Subtract(c2.Center).LengthSquared() < (c1.Radius+c2.Radius)*(c1.Radius+c2.Radius))
 }
 
+// CheckCircleWallCollision reports which face of the wall the circle has
+// pushed into, or NONE if it doesn't reach the wall. Y grows downwards, like
+// everywhere else. The face is the one the circle is least far through, so a
+// puck clipping a corner bounces off the side it came in by.
 func CheckCircleWallCollision(c1 Circle, wall *Rect) WallCollisionType {
-	threshold := -0.05
-
-	bottomCheck := (c1.Center.Y + c1.Radius) - (wall.topleft.Y - wall.height)
-	topCheck := (wall.topleft.Y) - (c1.Center.Y - c1.Radius)
-	leftCheck := (c1.Center.X + c1.Radius) - (wall.topleft.X)
-	rightCheck := (wall.topleft.X + wall.width) - (c1.Center.X - c1.Radius)
-
-	if bottomCheck < threshold || topCheck < threshold || leftCheck < threshold || rightCheck < threshold {
-		return NONE
-	} else if bottomCheck > threshold && bottomCheck < -threshold {
-		return BOTTOM
-	} else if topCheck > threshold && topCheck < -threshold {
-		return TOP
-	} else if leftCheck > threshold && leftCheck < -threshold {
-		return LEFT
-	} else if rightCheck > threshold && rightCheck < -threshold {
-		return RIGHT
-	} else {
-		fmt.Println("ERROR: Circle-Wall Collision failed -- CheckCircleWallCollision()")
+	if !wall.OverlapsCircle(c1) {
 		return NONE
 	}
+	// how far the circle would have to move to get out through each face
+	faces := []struct {
+		dir   WallCollisionType
+		depth float64
+	}{
+		{TOP, (c1.Center.Y + c1.Radius) - wall.TopLeft.Y},
+		{BOTTOM, (wall.TopLeft.Y + wall.Height) - (c1.Center.Y - c1.Radius)},
+		{LEFT, (c1.Center.X + c1.Radius) - wall.TopLeft.X},
+		{RIGHT, (wall.TopLeft.X + wall.Width) - (c1.Center.X - c1.Radius)},
+	}
+	least := faces[0]
+	for _, face := range faces[1:] {
+		if face.depth < least.depth {
+			least = face
+		}
+	}
+	return least.dir
 }
 
 func DoPositionalCorrection(c1 *Circle, c2 *Circle) {
@@ -148,12 +239,12 @@ func DoPositionalCorrection(c1 *Circle, c2 *Circle) {
 
 func FixOverlapX(dir WallCollisionType, circle *Circle, wall *Rect) {
 	if dir == LEFT {
-		overlap := (circle.Center.X + circle.Radius) - wall.topleft.X
+		overlap := (circle.Center.X + circle.Radius) - wall.TopLeft.X
 		if overlap > 0 {
 			circle.Center.X -= (overlap + 0.1)
 		}
 	} else if dir == RIGHT {
-		overlap := (circle.Center.X - circle.Radius) - (wall.topleft.X + wall.width)
+		overlap := (circle.Center.X - circle.Radius) - (wall.TopLeft.X + wall.Width)
 		if overlap < 0 {
 			circle.Center.X -= (overlap - 0.1)
 		}
@@ -162,19 +253,22 @@ func FixOverlapX(dir WallCollisionType, circle *Circle, wall *Rect) {
 
 func FixOverlapY(dir WallCollisionType, circle *Circle, wall *Rect) {
 	if dir == TOP {
-		overlap := (circle.Center.Y + circle.Radius) - wall.topleft.Y
+		overlap := (circle.Center.Y + circle.Radius) - wall.TopLeft.Y
 		if overlap > 0 {
 			circle.Center.Y -= (overlap + 0.1)
 		}
 	} else if dir == BOTTOM {
-		overlap := (circle.Center.Y - circle.Radius) - (wall.topleft.Y + wall.height)
+		overlap := (circle.Center.Y - circle.Radius) - (wall.TopLeft.Y + wall.Height)
 		if overlap < 0 {
 			circle.Center.Y -= (overlap - 0.1)
 		}
 	}
 }
 
-func ResolveCircleCircleCollisions(circles []*Circle) {
+// ResolveCircleCircleCollisions bounces every colliding pair apart and returns
+// the pairs that actually exchanged an impulse. Step is left for the caller.
+func ResolveCircleCircleCollisions(circles []*Circle) []Contact {
+	var contacts []Contact
 	//for all pairs, check collision and resolve if colliding
 	for i := 0; i < len(circles); i++ {
 		for j := i + 1; j < len(circles); j++ {
@@ -192,33 +286,49 @@ func ResolveCircleCircleCollisions(circles []*Circle) {
 				impulse := normal.Multiply(-speed)
 				circles[i].Velocity = circles[i].Velocity.Add(impulse)
 				circles[j].Velocity = circles[j].Velocity.Subtract(impulse)
+				contacts = append(contacts, Contact{A: i, B: j, Impulse: -speed})
 			}
 		}
 	}
+	return contacts
 }
 
-func ResolveCircleWallCollisions(circles []*Circle, walls []*Rect) {
+// ResolveCircleWallCollisions bounces circles off the walls they hit and
+// returns those bounces. Step is left for the caller.
+func ResolveCircleWallCollisions(circles []*Circle, walls []*Rect) []WallBounce {
+	var bounces []WallBounce
 	for i := range circles {
 		for j := range walls {
 			collisionDirection := CheckCircleWallCollision(*circles[i], walls[j])
 			collisionDetected := false
+			// only the speed into the face flips, a puck already on its way out keeps going
 			switch collisionDirection {
 			case NONE:
 
-			case TOP, BOTTOM:
-				circles[i].Velocity.Y *= -1
+			case TOP:
+				circles[i].Velocity.Y = -math.Abs(circles[i].Velocity.Y)
 				FixOverlapY(collisionDirection, circles[i], walls[j])
 				collisionDetected = true
-			case LEFT, RIGHT:
-				circles[i].Velocity.X *= -1
+			case BOTTOM:
+				circles[i].Velocity.Y = math.Abs(circles[i].Velocity.Y)
+				FixOverlapY(collisionDirection, circles[i], walls[j])
+				collisionDetected = true
+			case LEFT:
+				circles[i].Velocity.X = -math.Abs(circles[i].Velocity.X)
+				FixOverlapX(collisionDirection, circles[i], walls[j])
+				collisionDetected = true
+			case RIGHT:
+				circles[i].Velocity.X = math.Abs(circles[i].Velocity.X)
 				FixOverlapX(collisionDirection, circles[i], walls[j])
 				collisionDetected = true
 			}
 			if collisionDetected {
+				bounces = append(bounces, WallBounce{Circle: i, Wall: j})
 				break
 			}
 		}
 	}
+	return bounces
 }
 
 func ApplyFriction(circles []*Circle) {